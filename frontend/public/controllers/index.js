@@ -126,6 +126,23 @@ app
           $scope.showAlert('错误', '验证失败。');
         });
       };
+      $scope.login = () => {
+        $scope.loading(true);
+        $http.post('/login', {
+          email: $scope.user.email,
+          password: $scope.user.password,
+        }).then(success => {
+          $state.go('account', {
+            id: success.data
+          });
+        }).catch(error => {
+          $scope.loading(false);
+          if (error.data.startsWith('too many failed logins')) {
+            return $scope.showAlert('错误', '密码错误次数过多，请稍后再试或使用验证码登录。');
+          }
+          $scope.showAlert('错误', '邮箱或密码错误。忘记密码请使用验证码登录后重新设置。');
+        });
+      };
       $scope.emailKeypress = function(e) {
         if (e.keyCode === 13 && $scope.user.email) {
           $scope.sendCode();
@@ -136,6 +153,11 @@ app
           $scope.checkCode();
         }
       };
+      $scope.passwordKeypress = function(e) {
+        if (e.keyCode === 13 && $scope.user.email && $scope.user.password) {
+          $scope.login();
+        }
+      };
       $scope.manager = function() {
         $http.post('/config').then(function() {
           $state.go('manager');
@@ -150,11 +172,6 @@ app
   ])
   .controller('AccountController', ['$scope', '$http', '$state', '$stateParams', '$interval',
     ($scope, $http, $state, $stateParams, $interval) => {
-      const b64EncodeUnicode = str => {
-        return btoa(encodeURIComponent(str).replace(/%([0-9A-F]{2})/g, (match, p1) => {
-          return String.fromCharCode('0x' + p1);
-        }));
-      };
       $scope.getAccount = () => {
         $scope.loading(true);
         $http.post('/account', {
@@ -162,16 +179,24 @@ app
         }).then(success => {
           $scope.loading(false);
           $scope.accountInfo = success.data;
-          for (let i = 0; i < $scope.accountInfo.servers.length; i++) {
-            let server = $scope.accountInfo.servers[i];
-            server.qrcode = 'ss://' + b64EncodeUnicode($scope.accountInfo.method + ':' + server.password + '@' + server.host + ':' + server.port);
-          }
         }, error => {
           $scope.loading(false);
           $state.go('index');
         });
       };
       $scope.getAccount();
+      $scope.password = {};
+      $scope.setPassword = () => {
+        $http.put('/account/password', {
+          password: $scope.password.value
+        }).then(success => {
+          $scope.password = {};
+          $scope.accountInfo.hasPassword = true;
+          $scope.showAlert('提示', '密码设置成功。');
+        }).catch(error => {
+          $scope.showAlert('错误', '密码设置失败，密码长度需为 8 到 72 位。');
+        });
+      };
       const interval = $interval(function() {
         $scope.getAccount();
       }, 60 * 1000);
@@ -7,12 +7,13 @@ app
     $scope.checkPassword = () => {
       $scope.loading(true);
       $http.post('/password', {
+        username: $scope.user.username,
         password: $scope.user.password
       }).then(() => {
         $state.go('manager');
       }).catch(() => {
         $scope.loading(false);
-        $scope.showAlert('错误', '管理员密码验证失败。');
+        $scope.showAlert('错误', '管理员用户名或密码错误。');
       });
     };
     $scope.passwordKeypress = e => {
@@ -105,14 +106,24 @@ app
       }]);
     };
     $timeout(() => { menu(); }, 250);
+    $scope.query = {
+      page: 1,
+      perPage: 50,
+      email: '',
+      state: '',
+      sort: 'created',
+      order: 'desc',
+    };
     $scope.getUsersAndGroups = () => {
       $scope.users || $scope.loading(true);
       $http.post('/group')
       .then(success => {
           $scope.groups = success.data;
-          return $http.post('/user');
+          return $http.post('/user', $scope.query);
       }).then(success => {
-        $scope.users = success.data;
+        $scope.users = success.data.items;
+        $scope.total = success.data.total;
+        $scope.pages = Math.max(1, Math.ceil(success.data.total / success.data.perPage));
         return $http.post('/flow');
       }).then(success => {
         $scope.flow = success.data.flow;
@@ -124,6 +135,15 @@ app
         }
       });
     };
+    $scope.search = () => {
+      $scope.query.page = 1;
+      $scope.getUsersAndGroups();
+    };
+    $scope.toPage = page => {
+      if(page < 1 || page > $scope.pages) { return; }
+      $scope.query.page = page;
+      $scope.getUsersAndGroups();
+    };
     $scope.getUsersAndGroups();
     const interval = $interval(() => {
       $scope.getUsersAndGroups();
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/kataras/iris"
+
+	rpc "github.com/arkbriar/ssmgr/protocol"
+)
+
+// ACLConfig is a named policy of destinations blocked on slaves.
+type ACLConfig struct {
+	Name string `json:"name"`
+	// Rules are IPs, CIDRs or regexes of hostnames, in the outbound block list of ss-server.
+	Rules []string `json:"rules"`
+}
+
+// builtinACLs are available without being configured, an ACL configured with the same name
+// overrides the built-in one.
+var builtinACLs = map[string][]string{
+	// private, loopback and link-local networks
+	"block-lan": {
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+		"172.16.0.0/12", "192.168.0.0/16", "::1/128", "fc00::/7", "fe80::/10",
+	},
+}
+
+// aclMu guards config.ACLs, which are changed by admins.
+var aclMu sync.RWMutex
+
+// findACL returns the rules of the ACL named name.
+func findACL(name string) ([]string, bool) {
+	for _, acl := range config.ACLs {
+		if acl.Name == name {
+			return acl.Rules, true
+		}
+	}
+	rules, ok := builtinACLs[name]
+	return rules, ok
+}
+
+// aclRulesOf returns the rules of all ACLs assigned to the group, rules repeated are removed.
+func aclRulesOf(groupID string) []string {
+	aclMu.RLock()
+	defer aclMu.RUnlock()
+
+	group := getGroup(groupID)
+	if group == nil {
+		return nil
+	}
+
+	var rules []string
+	seen := make(map[string]bool)
+	for _, name := range group.Config.ACLs {
+		acl, ok := findACL(name)
+		if !ok {
+			logrus.Warnf("ACL '%s' of group '%s' not found", name, groupID)
+			continue
+		}
+		for _, rule := range acl {
+			if !seen[rule] {
+				seen[rule] = true
+				rules = append(rules, rule)
+			}
+		}
+	}
+	return rules
+}
+
+func handleACL(ctx *iris.Context) {
+	if !requirePermission(ctx, permSettingsRead) {
+		return
+	}
+
+	aclMu.RLock()
+	defer aclMu.RUnlock()
+
+	acls := make([]*ACLConfig, 0, len(config.ACLs)+len(builtinACLs))
+	acls = append(acls, config.ACLs...)
+	for name, rules := range builtinACLs {
+		if !isBuiltinACL(name) {
+			continue
+		}
+		acls = append(acls, &ACLConfig{Name: name, Rules: rules})
+	}
+	ctx.JSON(iris.StatusOK, acls)
+}
+
+// isBuiltinACL returns if the ACL named name is not overridden by config.
+func isBuiltinACL(name string) bool {
+	for _, acl := range config.ACLs {
+		if acl.Name == name {
+			return false
+		}
+	}
+	_, ok := builtinACLs[name]
+	return ok
+}
+
+// handleACLPut creates or updates an ACL, or removes it when there's no rules. Slaves pick up
+// the changes in the next monitoring loop.
+func handleACLPut(ctx *iris.Context) {
+	if !requirePermission(ctx, permSettingsWrite) {
+		return
+	}
+
+	var req ACLConfig
+	if err := ctx.ReadJSON(&req); err != nil {
+		panic(err.Error())
+	}
+	if len(req.Name) == 0 {
+		ctx.WriteString("name is required")
+		return
+	}
+	for _, rule := range req.Rules {
+		if err := rpc.ValidACLRule(rule); err != nil {
+			ctx.WriteString(err.Error())
+			return
+		}
+	}
+
+	aclMu.Lock()
+	acls := make([]*ACLConfig, 0, len(config.ACLs)+1)
+	for _, acl := range config.ACLs {
+		if acl.Name != req.Name {
+			acls = append(acls, acl)
+		}
+	}
+	if len(req.Rules) != 0 {
+		acls = append(acls, &req)
+	}
+	config.ACLs = acls
+	aclMu.Unlock()
+
+	go func() {
+		if err := saveConfig(); err != nil {
+			logrus.Warnf("Failed to save config: %s", err.Error())
+		}
+	}()
+	ctx.WriteString("success")
+}
+
+// handleGroupACLPut assigns ACLs to a group.
+func handleGroupACLPut(ctx *iris.Context) {
+	if !requirePermission(ctx, permSettingsWrite) {
+		return
+	}
+
+	var req struct {
+		GroupID string   `json:"group_id"`
+		ACLs    []string `json:"acls"`
+	}
+	if err := ctx.ReadJSON(&req); err != nil {
+		panic(err.Error())
+	}
+
+	group := getGroup(req.GroupID)
+	if group == nil {
+		ctx.WriteString("group " + req.GroupID + " not found")
+		return
+	}
+	c := *group.Config
+	c.ACLs = req.ACLs
+	if err := saveGroup(&c); err != nil {
+		ctx.WriteString(err.Error())
+		return
+	}
+	ctx.WriteString("success")
+}
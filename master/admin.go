@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/asaskevich/govalidator"
+	"github.com/kataras/iris"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/arkbriar/ssmgr/master/orm"
+)
+
+// Roles of admins.
+const (
+	roleOwner    = "owner"
+	roleOperator = "operator"
+	roleSupport  = "support"
+)
+
+// permission is what an admin handler needs.
+type permission int
+
+const (
+	// permUsersRead allows reading users, their flows and accounts.
+	permUsersRead permission = iota
+	// permUsersWrite allows changing users.
+	permUsersWrite
+	// permSettingsRead allows reading config, ACLs, templates, mails and metrics.
+	permSettingsRead
+	// permSettingsWrite allows changing config, ACLs, templates and retrying mails.
+	permSettingsWrite
+	// permAdminsManage allows managing admins.
+	permAdminsManage
+)
+
+var rolePermissions = map[string][]permission{
+	roleOwner:    {permUsersRead, permUsersWrite, permSettingsRead, permSettingsWrite, permAdminsManage},
+	roleOperator: {permUsersRead, permUsersWrite, permSettingsRead, permSettingsWrite},
+	roleSupport:  {permUsersRead, permSettingsRead},
+}
+
+func validRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// legacyAdmin is the owner created from the password in config.json.
+const legacyAdmin = "admin"
+
+// InitAdmins moves the password in config.json into the owner "admin" when there's no admin yet,
+// so that upgraded masters can still be managed. The password is removed from config.json.
+func InitAdmins() {
+	var count int
+	db.Model(&orm.Admin{}).Count(&count)
+	if count == 0 && len(config.Password) == 0 {
+		logrus.Warnf("No admin exists, create one with `%s admin add -role owner <username>`", os.Args[0])
+		return
+	}
+	if len(config.Password) == 0 {
+		return
+	}
+
+	if count == 0 {
+		if err := createAdmin(legacyAdmin, config.Password, roleOwner); err != nil {
+			logrus.Errorf("Failed to create admin from config: %s", err.Error())
+			return
+		}
+		logrus.Infof("Created owner %q with the password in config.json", legacyAdmin)
+	}
+	config.Password = ""
+	if err := saveConfig(); err != nil {
+		logrus.Warnf("Failed to save config: %s", err.Error())
+	}
+}
+
+func createAdmin(username, password, role string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	return db.Create(&orm.Admin{
+		Username:     username,
+		PasswordHash: string(hash),
+		Role:         role,
+		Created:      time.Now().Unix(),
+	}).Error
+}
+
+// isLastOwner tells whether the admin is the only owner, who can't be removed or demoted.
+func isLastOwner(username string) bool {
+	var owners []orm.Admin
+	db.Where("role = ?", roleOwner).Find(&owners)
+	return len(owners) == 1 && owners[0].Username == username
+}
+
+// currentAdmin returns the admin logged in, or nil.
+func currentAdmin(ctx *iris.Context) *orm.Admin {
+	username := ctx.Session().GetString("admin")
+	if len(username) == 0 {
+		return nil
+	}
+	var admin orm.Admin
+	db.Where("username = ?", username).First(&admin)
+	if admin.Username == "" {
+		return nil
+	}
+	return &admin
+}
+
+// hasPermission tells whether the admin logged in has the permission.
+func hasPermission(ctx *iris.Context, perm permission) bool {
+	admin := currentAdmin(ctx)
+	if admin == nil {
+		return false
+	}
+	for _, p := range rolePermissions[admin.Role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// requirePermission responds with an error if the admin logged in doesn't have the permission.
+func requirePermission(ctx *iris.Context, perm permission) bool {
+	if currentAdmin(ctx) == nil {
+		ctx.SetStatusCode(iris.StatusUnauthorized)
+		ctx.WriteString("please login first")
+		return false
+	}
+	if !hasPermission(ctx, perm) {
+		ctx.SetStatusCode(iris.StatusForbidden)
+		ctx.WriteString("permission denied")
+		return false
+	}
+	return true
+}
+
+// handlePassword logs in an admin with username and password. Admins are locked like users after
+// too many wrong passwords.
+func handlePassword(ctx *iris.Context) {
+	var request struct {
+		Username string `json:"username" valid:"-"`
+		Password string `json:"password" valid:"-"`
+	}
+	if err := ctx.ReadJSON(&request); err != nil {
+		panic(err.Error())
+	}
+	if _, err := govalidator.ValidateStruct(&request); err != nil {
+		ctx.WriteString(err.Error())
+		return
+	}
+
+	var admin orm.Admin
+	if len(request.Username) != 0 {
+		db.Where("username = ?", request.Username).First(&admin)
+	}
+	if admin.LockedUntil > time.Now().Unix() {
+		ctx.SetStatusCode(iris.StatusForbidden)
+		ctx.WriteString("too many failed logins, try again later")
+		return
+	}
+
+	hash := dummyPasswordHash
+	if len(admin.PasswordHash) != 0 {
+		hash = []byte(admin.PasswordHash)
+	}
+	err := bcrypt.CompareHashAndPassword(hash, []byte(request.Password))
+	if err != nil || len(admin.PasswordHash) == 0 {
+		if len(admin.PasswordHash) != 0 {
+			recordFailedLogin("admins", "username", admin.Username)
+		}
+		ctx.SetStatusCode(iris.StatusForbidden)
+		ctx.WriteString("login failed")
+		return
+	}
+
+	if admin.FailedLogins != 0 {
+		unlockLogin("admins", "username", admin.Username)
+	}
+	ctx.Session().Set("admin", admin.Username)
+	ctx.JSON(iris.StatusOK, map[string]string{
+		"username": admin.Username,
+		"role":     admin.Role,
+	})
+}
+
+// handleAdmin lists the admins.
+func handleAdmin(ctx *iris.Context) {
+	if !requirePermission(ctx, permAdminsManage) {
+		return
+	}
+
+	type adminInfo struct {
+		Username string `json:"username"`
+		Role     string `json:"role"`
+		Created  int64  `json:"created"`
+	}
+	var admins []orm.Admin
+	db.Order("username").Find(&admins)
+	infos := make([]*adminInfo, 0, len(admins))
+	for _, admin := range admins {
+		infos = append(infos, &adminInfo{
+			Username: admin.Username,
+			Role:     admin.Role,
+			Created:  admin.Created * 1000, // convert to milliseconds
+		})
+	}
+	ctx.JSON(iris.StatusOK, infos)
+}
+
+// handleAdminPut creates or changes an admin, or removes it if delete is true. Empty fields are
+// left unchanged.
+func handleAdminPut(ctx *iris.Context) {
+	if !requirePermission(ctx, permAdminsManage) {
+		return
+	}
+
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Role     string `json:"role"`
+		Delete   bool   `json:"delete"`
+	}
+	if err := ctx.ReadJSON(&req); err != nil {
+		panic(err.Error())
+	}
+	if len(req.Username) == 0 {
+		ctx.WriteString("username is required")
+		return
+	}
+	if len(req.Role) != 0 && !validRole(req.Role) {
+		ctx.WriteString("unknown role " + req.Role)
+		return
+	}
+	if len(req.Password) != 0 && (len(req.Password) < minPasswordLength || len(req.Password) > maxPasswordLength) {
+		ctx.WriteString("password must be 8 to 72 characters")
+		return
+	}
+
+	var admin orm.Admin
+	db.Where("username = ?", req.Username).First(&admin)
+
+	if req.Delete || (len(req.Role) != 0 && req.Role != roleOwner) {
+		if isLastOwner(req.Username) {
+			ctx.WriteString("the last owner can't be removed or demoted")
+			return
+		}
+	}
+
+	if req.Delete {
+		db.Where("username = ?", req.Username).Delete(&orm.Admin{})
+		logrus.Infof("Admin %s is removed by %s", req.Username, currentAdmin(ctx).Username)
+		ctx.WriteString("success")
+		return
+	}
+
+	if admin.Username == "" {
+		if len(req.Password) == 0 || len(req.Role) == 0 {
+			ctx.WriteString("password and role are required for a new admin")
+			return
+		}
+		if err := createAdmin(req.Username, req.Password, req.Role); err != nil {
+			ctx.WriteString(err.Error())
+			return
+		}
+		logrus.Infof("Admin %s (%s) is created by %s", req.Username, req.Role, currentAdmin(ctx).Username)
+		ctx.WriteString("success")
+		return
+	}
+
+	updates := make(map[string]interface{})
+	if len(req.Role) != 0 {
+		updates["role"] = req.Role
+	}
+	if len(req.Password) != 0 {
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			panic(err.Error())
+		}
+		updates["password_hash"] = string(hash)
+		updates["failed_logins"] = 0
+		updates["locked_until"] = 0
+	}
+	if len(updates) != 0 {
+		db.Table("admins").Where("username = ?", req.Username).Updates(updates)
+	}
+	ctx.WriteString("success")
+}
+
+// readPassword reads a password from the terminal without echo, or a line from stdin if it's not
+// a terminal.
+func readPassword(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && len(line) == 0 {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	password, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "Retype password: ")
+	again, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if string(password) != string(again) {
+		return "", errors.New("passwords do not match")
+	}
+	return string(password), nil
+}
+
+// runAdmin manages admins in the database.
+func runAdmin(args []string) error {
+	fs := flag.NewFlagSet("admin", flag.ExitOnError)
+	var (
+		role   = fs.String("role", "", "Role of the admin, one of owner, operator and support")
+		scopes = fs.String("scopes", "", "Comma separated scopes of the API token")
+		name   = fs.String("name", "", "Name of the API token")
+		days   = fs.Int("days", 0, "Days before the API token expires, 0 for never")
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-c config] admin list\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [-c config] admin add -role <role> <username>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [-c config] admin passwd <username>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [-c config] admin role -role <role> <username>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [-c config] admin remove <username>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [-c config] admin token -name <name> -scopes <scopes> [-days <days>] <username>\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Passwords are read from the terminal, or from stdin if it's not a terminal.")
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		return errors.New("admin command is required")
+	}
+	command := args[0]
+	fs.Parse(args[1:])
+
+	db = orm.New(config.Database.Dialect, config.Database.Args)
+	defer db.Close()
+
+	if command == "list" {
+		var admins []orm.Admin
+		db.Order("username").Find(&admins)
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "USERNAME\tROLE\tCREATED")
+		for _, admin := range admins {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", admin.Username, admin.Role,
+				time.Unix(admin.Created, 0).Format("2006-01-02 15:04"))
+		}
+		return w.Flush()
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("username is required")
+	}
+	username := fs.Arg(0)
+	var admin orm.Admin
+	db.Where("username = ?", username).First(&admin)
+	if command != "add" && admin.Username == "" {
+		return fmt.Errorf("admin %s not found", username)
+	}
+
+	switch command {
+	case "add":
+		if admin.Username != "" {
+			return fmt.Errorf("admin %s exists", username)
+		}
+		if !validRole(*role) {
+			return errors.New("-role must be one of owner, operator and support")
+		}
+		password, err := readPassword("Password: ")
+		if err != nil {
+			return err
+		}
+		if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+			return errors.New("password must be 8 to 72 characters")
+		}
+		if err := createAdmin(username, password, *role); err != nil {
+			return err
+		}
+		fmt.Printf("Admin %s (%s) is created\n", username, *role)
+	case "passwd":
+		password, err := readPassword("New password: ")
+		if err != nil {
+			return err
+		}
+		if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+			return errors.New("password must be 8 to 72 characters")
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		db.Table("admins").Where("username = ?", username).Updates(map[string]interface{}{
+			"password_hash": string(hash),
+			"failed_logins": 0,
+			"locked_until":  0,
+		})
+		fmt.Printf("Password of admin %s is changed\n", username)
+	case "role":
+		if !validRole(*role) {
+			return errors.New("-role must be one of owner, operator and support")
+		}
+		if *role != roleOwner && isLastOwner(username) {
+			return errors.New("the last owner can't be demoted")
+		}
+		db.Table("admins").Where("username = ?", username).Update("role", *role)
+		fmt.Printf("Admin %s is %s now\n", username, *role)
+	case "remove":
+		if isLastOwner(username) {
+			return errors.New("the last owner can't be removed")
+		}
+		db.Where("username = ?", username).Delete(&orm.Admin{})
+		fmt.Printf("Admin %s is removed\n", username)
+	case "token":
+		if len(*name) == 0 || len(*scopes) == 0 {
+			return errors.New("-name and -scopes are required")
+		}
+		token, _, err := issueAPIToken(&admin, *name, strings.Split(*scopes, ","), *days)
+		if err != nil {
+			return err
+		}
+		fmt.Println(token)
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown admin command %s", command)
+	}
+	return nil
+}
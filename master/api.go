@@ -0,0 +1,393 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/kataras/iris"
+
+	"github.com/arkbriar/ssmgr/master/orm"
+)
+
+const apiPrefix = "/api/v1"
+
+// Scopes of API tokens, each grants the permission of the same name to the token, as long as the
+// admin owning it has the permission.
+var apiScopes = map[string]permission{
+	"users:read":     permUsersRead,
+	"users:write":    permUsersWrite,
+	"settings:read":  permSettingsRead,
+	"settings:write": permSettingsWrite,
+}
+
+// apiParam is a query param of an API, documented in the OpenAPI spec.
+type apiParam struct {
+	Name        string
+	Type        string
+	Description string
+}
+
+// apiRoute is an API under apiPrefix. Path params are written as "{name}".
+type apiRoute struct {
+	Method  string
+	Path    string
+	Summary string
+	// Scope is required to call the API, empty for public APIs.
+	Scope string
+	// SessionOnly APIs can't be called with API tokens.
+	SessionOnly bool
+	Query       []apiParam
+	// Paginated APIs take "page" and "per_page" and respond with an apiPage of Response.
+	Paginated bool
+	// Body and Response are zero values of the types of the request and response bodies, for
+	// the OpenAPI spec.
+	Body     interface{}
+	Response interface{}
+	// Status is the status code of a successful response, defaults to 200.
+	Status int
+	Handle func(r *apiRequest)
+}
+
+// apiRequest is an authenticated call of an API.
+type apiRequest struct {
+	ctx    *iris.Context
+	params map[string]string
+	// admin is the admin calling the API, or owning the token.
+	admin *orm.Admin
+	// token is nil if the API is called with a session.
+	token *orm.APIToken
+}
+
+// apiError is the body of failed responses, wrapped in {"error": ...}.
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// apiPage is the body of paginated responses.
+type apiPage struct {
+	Items   interface{} `json:"items"`
+	Page    int         `json:"page"`
+	PerPage int         `json:"perPage"`
+	Total   int64       `json:"total"`
+}
+
+const (
+	defaultPerPage = 50
+	maxPerPage     = 500
+)
+
+func (r *apiRequest) param(name string) string {
+	return r.params[name]
+}
+
+func (r *apiRequest) query(name string) string {
+	return r.ctx.URLParam(name)
+}
+
+// readBody parses the JSON body, and responds with an error if it fails.
+func (r *apiRequest) readBody(v interface{}) bool {
+	if err := r.ctx.ReadJSON(v); err != nil {
+		r.fail(http.StatusBadRequest, "invalid_body", err.Error())
+		return false
+	}
+	return true
+}
+
+// pagination returns the page (from 1) and the number of items per page requested.
+func (r *apiRequest) pagination() (page, perPage int) {
+	page, _ = strconv.Atoi(r.query("page"))
+	perPage, _ = strconv.Atoi(r.query("per_page"))
+	return clampPage(page, perPage)
+}
+
+func (r *apiRequest) respond(status int, v interface{}) {
+	if v == nil {
+		r.ctx.SetStatusCode(status)
+		return
+	}
+	r.ctx.JSON(status, v)
+}
+
+func (r *apiRequest) fail(status int, code, message string) {
+	apiFail(r.ctx, status, code, message)
+}
+
+func (r *apiRequest) notFound(what string) {
+	r.fail(http.StatusNotFound, "not_found", what+" not found")
+}
+
+func apiFail(ctx *iris.Context, status int, code, message string) {
+	ctx.JSON(status, map[string]*apiError{"error": {Code: code, Message: message}})
+}
+
+// apiAuthenticate finds the admin calling the API with a bearer token or a session.
+func apiAuthenticate(ctx *iris.Context) (*orm.Admin, *orm.APIToken) {
+	auth := ctx.RequestHeader("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return currentAdmin(ctx), nil
+	}
+
+	token := findAPIToken(strings.TrimSpace(strings.TrimPrefix(auth, "Bearer ")))
+	if token == nil {
+		return nil, nil
+	}
+	var admin orm.Admin
+	db.Where("username = ?", token.Admin).First(&admin)
+	if admin.Username == "" {
+		return nil, nil
+	}
+	return &admin, token
+}
+
+// allowed tells whether the caller has the scope, through both the role of the admin and the
+// scopes of the token.
+func (r *apiRequest) allowed(scope string) bool {
+	perm, ok := apiScopes[scope]
+	if !ok {
+		return false
+	}
+	if r.token != nil && !tokenHasScope(r.token, scope) {
+		return false
+	}
+	for _, p := range rolePermissions[r.admin.Role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAPIPath matches the path against the pattern, and returns the path params.
+func matchAPIPath(pattern, path string) (map[string]string, bool) {
+	patternParts := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathParts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(patternParts) != len(pathParts) {
+		return nil, false
+	}
+
+	params := make(map[string]string)
+	for i, part := range patternParts {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			if len(pathParts[i]) == 0 {
+				return nil, false
+			}
+			params[part[1:len(part)-1]] = pathParts[i]
+		} else if part != pathParts[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// handleAPI dispatches the requests under apiPrefix to apiRoutes.
+func handleAPI(ctx *iris.Context) {
+	path := strings.TrimPrefix(ctx.Request.URL.Path, apiPrefix)
+
+	pathFound := false
+	for _, route := range apiRoutes {
+		params, ok := matchAPIPath(route.Path, path)
+		if !ok {
+			continue
+		}
+		pathFound = true
+		if route.Method != ctx.Method() {
+			continue
+		}
+
+		r := &apiRequest{ctx: ctx, params: params}
+		if len(route.Scope) != 0 || route.SessionOnly {
+			r.admin, r.token = apiAuthenticate(ctx)
+			if r.admin == nil {
+				apiFail(ctx, http.StatusUnauthorized, "unauthorized", "a valid API token or admin session is required")
+				return
+			}
+			if route.SessionOnly && r.token != nil {
+				apiFail(ctx, http.StatusForbidden, "forbidden", "this API can't be called with API tokens")
+				return
+			}
+			if len(route.Scope) != 0 && !r.allowed(route.Scope) {
+				apiFail(ctx, http.StatusForbidden, "forbidden", "scope "+route.Scope+" is required")
+				return
+			}
+		}
+		route.Handle(r)
+		return
+	}
+
+	if pathFound {
+		apiFail(ctx, http.StatusMethodNotAllowed, "method_not_allowed", ctx.Method()+" is not allowed")
+		return
+	}
+	apiFail(ctx, http.StatusNotFound, "not_found", "API not found")
+}
+
+// openAPISpec generates the OpenAPI 3 document of apiRoutes.
+func openAPISpec() map[string]interface{} {
+	errorSchema := map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"error": schemaOf(reflect.TypeOf(apiError{})),
+		},
+	}
+
+	paths := make(map[string]map[string]interface{})
+	for _, route := range apiRoutes {
+		var params []map[string]interface{}
+		for _, part := range strings.Split(route.Path, "/") {
+			if strings.HasPrefix(part, "{") {
+				params = append(params, map[string]interface{}{
+					"name":     strings.Trim(part, "{}"),
+					"in":       "path",
+					"required": true,
+					"schema":   map[string]string{"type": "string"},
+				})
+			}
+		}
+		query := append([]apiParam{}, route.Query...)
+		if route.Paginated {
+			query = append(query,
+				apiParam{"page", "integer", "Page number, from 1."},
+				apiParam{"per_page", "integer", "Items per page, 50 by default and 500 at most."})
+		}
+		for _, q := range query {
+			params = append(params, map[string]interface{}{
+				"name":        q.Name,
+				"in":          "query",
+				"description": q.Description,
+				"schema":      map[string]string{"type": q.Type},
+			})
+		}
+
+		status := route.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		success := map[string]interface{}{"description": http.StatusText(status)}
+		if route.Response != nil {
+			schema := schemaOf(reflect.TypeOf(route.Response))
+			if route.Paginated {
+				page := schemaOf(reflect.TypeOf(apiPage{}))
+				page["properties"].(map[string]interface{})["items"] = map[string]interface{}{
+					"type":  "array",
+					"items": schema,
+				}
+				schema = page
+			}
+			success["content"] = map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": schema},
+			}
+		}
+
+		op := map[string]interface{}{
+			"summary": route.Summary,
+			"responses": map[string]interface{}{
+				strconv.Itoa(status): success,
+				"default": map[string]interface{}{
+					"description": "Error",
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{"schema": errorSchema},
+					},
+				},
+			},
+		}
+		if len(params) != 0 {
+			op["parameters"] = params
+		}
+		if route.Body != nil {
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": schemaOf(reflect.TypeOf(route.Body))},
+				},
+			}
+		}
+		switch {
+		case route.SessionOnly:
+			op["security"] = []map[string][]string{{"session": {}}}
+		case len(route.Scope) != 0:
+			op["security"] = []map[string][]string{{"token": {route.Scope}}, {"session": {}}}
+		default:
+			op["security"] = []map[string][]string{}
+		}
+
+		if paths[route.Path] == nil {
+			paths[route.Path] = make(map[string]interface{})
+		}
+		paths[route.Path][strings.ToLower(route.Method)] = op
+	}
+
+	scopes := make([]string, 0, len(apiScopes))
+	for scope := range apiScopes {
+		scopes = append(scopes, scope)
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.0",
+		"info": map[string]string{
+			"title":       "ssmgr master API",
+			"version":     "1",
+			"description": "Times are unix seconds, and flows are bytes. Scopes of tokens: " + strings.Join(sortedStrings(scopes), ", ") + ".",
+		},
+		"servers": []map[string]string{{"url": apiPrefix}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"securitySchemes": map[string]interface{}{
+				"token":   map[string]string{"type": "http", "scheme": "bearer"},
+				"session": map[string]string{"type": "apiKey", "in": "cookie", "name": "irissessionid"},
+			},
+		},
+	}
+}
+
+// schemaOf generates the JSON schema of the type from its fields and json tags.
+func schemaOf(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem())}
+	case reflect.Struct:
+		props := make(map[string]interface{})
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.Anonymous && field.Type.Kind() == reflect.Struct && len(field.Tag.Get("json")) == 0 {
+				// fields of embedded structs are inlined
+				for name, prop := range schemaOf(field.Type)["properties"].(map[string]interface{}) {
+					props[name] = prop
+				}
+				continue
+			}
+			if field.PkgPath != "" {
+				continue
+			}
+			name := field.Name
+			if tag := field.Tag.Get("json"); len(tag) != 0 {
+				if tag == "-" {
+					continue
+				}
+				if n := strings.Split(tag, ",")[0]; len(n) != 0 {
+					name = n
+				}
+			}
+			props[name] = schemaOf(field.Type)
+		}
+		return map[string]interface{}{"type": "object", "properties": props}
+	default:
+		return map[string]interface{}{}
+	}
+}
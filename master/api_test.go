@@ -0,0 +1,39 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMatchAPIPath(t *testing.T) {
+	cases := []struct {
+		pattern string
+		path    string
+		ok      bool
+		params  map[string]string
+	}{
+		{"/users", "/users", true, map[string]string{}},
+		{"/users", "/users/", true, map[string]string{}},
+		{"/users", "users", true, map[string]string{}},
+		{"/users", "/groups", false, nil},
+		{"/users", "/users/abc", false, nil},
+		{"/users/{id}", "/users", false, nil},
+		{"/users/{id}", "/users/abc", true, map[string]string{"id": "abc"}},
+		{"/users/{id}", "/users/abc/", true, map[string]string{"id": "abc"}},
+		{"/users/{id}", "/users//", false, nil},
+		{"/users/{id}/usage", "/users/abc/usage", true, map[string]string{"id": "abc"}},
+		{"/users/{id}/usage", "/users/abc/allocations", false, nil},
+		{"/users/{id}/usage", "/users/abc/usage/series", false, nil},
+		{"/users/{id}/usage/series", "/users/abc/usage/series", true, map[string]string{"id": "abc"}},
+		{"/users/{id}/usage/series", "/users//usage/series", false, nil},
+		{"/a/{x}/b/{y}", "/a/1/b/2", true, map[string]string{"x": "1", "y": "2"}},
+		{"/openapi.json", "/openapi.json", true, map[string]string{}},
+		{"/openapi.json", "/openapi", false, nil},
+	}
+	for _, c := range cases {
+		params, ok := matchAPIPath(c.pattern, c.path)
+		if ok != c.ok || !reflect.DeepEqual(params, c.params) {
+			t.Errorf("matchAPIPath(%q, %q) = %v, %t, want %v, %t", c.pattern, c.path, params, ok, c.params, c.ok)
+		}
+	}
+}
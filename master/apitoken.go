@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/arkbriar/ssmgr/master/orm"
+)
+
+// apiTokenPrefix starts every API token, so that leaked tokens are easy to find.
+const apiTokenPrefix = "ssmgr_"
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// findAPIToken returns the valid token, or nil if it's unknown, revoked or expired.
+func findAPIToken(token string) *orm.APIToken {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return nil
+	}
+
+	var t orm.APIToken
+	db.Where("hash = ?", hashAPIToken(token)).First(&t)
+	now := time.Now().Unix()
+	if t.ID == 0 || t.Revoked != 0 || (t.Expires != 0 && t.Expires <= now) {
+		return nil
+	}
+	db.Table(orm.APIToken{}.TableName()).Where("id = ?", t.ID).Update("last_used", now)
+	return &t
+}
+
+func tokenHasScope(t *orm.APIToken, scope string) bool {
+	for _, s := range strings.Split(t.Scopes, ",") {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedStrings(s []string) []string {
+	sort.Strings(s)
+	return s
+}
+
+// issueAPIToken creates a token of the admin with the scopes, which expires in days (0 for never).
+// The token itself is only returned here, only its hash is stored.
+func issueAPIToken(admin *orm.Admin, name string, scopes []string, days int) (string, *orm.APIToken, error) {
+	if len(scopes) == 0 {
+		return "", nil, errors.New("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		perm, ok := apiScopes[scope]
+		if !ok {
+			return "", nil, errors.New("unknown scope " + scope)
+		}
+		granted := false
+		for _, p := range rolePermissions[admin.Role] {
+			granted = granted || p == perm
+		}
+		if !granted {
+			return "", nil, errors.New("role " + admin.Role + " can't grant scope " + scope)
+		}
+	}
+
+	random, err := randomToken()
+	if err != nil {
+		return "", nil, err
+	}
+	token := apiTokenPrefix + random
+
+	now := time.Now()
+	t := &orm.APIToken{
+		Name:    name,
+		Admin:   admin.Username,
+		Scopes:  strings.Join(sortedStrings(scopes), ","),
+		Hash:    hashAPIToken(token),
+		Prefix:  token[:len(apiTokenPrefix)+4],
+		Created: now.Unix(),
+	}
+	if days > 0 {
+		t.Expires = now.Add(time.Duration(days) * 24 * time.Hour).Unix()
+	}
+	if err := db.Create(t).Error; err != nil {
+		return "", nil, err
+	}
+	return token, t, nil
+}
+
+type apiTokenInfo struct {
+	ID       uint     `json:"id"`
+	Name     string   `json:"name"`
+	Admin    string   `json:"admin"`
+	Scopes   []string `json:"scopes"`
+	Prefix   string   `json:"prefix"`
+	Created  int64    `json:"created"`
+	LastUsed int64    `json:"lastUsed"`
+	Expires  int64    `json:"expires"`
+	Revoked  int64    `json:"revoked"`
+}
+
+func newAPITokenInfo(t *orm.APIToken) *apiTokenInfo {
+	return &apiTokenInfo{
+		ID:       t.ID,
+		Name:     t.Name,
+		Admin:    t.Admin,
+		Scopes:   strings.Split(t.Scopes, ","),
+		Prefix:   t.Prefix,
+		Created:  t.Created,
+		LastUsed: t.LastUsed,
+		Expires:  t.Expires,
+		Revoked:  t.Revoked,
+	}
+}
+
+type apiTokenRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// Days before the token expires, 0 for never.
+	Days int `json:"days"`
+}
+
+type apiTokenCreated struct {
+	// Token is only shown once.
+	Token string `json:"token"`
+	apiTokenInfo
+}
+
+// apiListTokens lists the tokens of the admin, or of all admins for owners.
+func apiListTokens(r *apiRequest) {
+	var tokens []orm.APIToken
+	query := db.Order("id")
+	if r.admin.Role != roleOwner {
+		query = query.Where("admin = ?", r.admin.Username)
+	}
+	query.Find(&tokens)
+
+	infos := make([]*apiTokenInfo, 0, len(tokens))
+	for i := range tokens {
+		infos = append(infos, newAPITokenInfo(&tokens[i]))
+	}
+	r.respond(http.StatusOK, infos)
+}
+
+func apiCreateToken(r *apiRequest) {
+	var req apiTokenRequest
+	if !r.readBody(&req) {
+		return
+	}
+	if len(req.Name) == 0 {
+		r.fail(http.StatusBadRequest, "invalid_body", "name is required")
+		return
+	}
+
+	token, t, err := issueAPIToken(r.admin, req.Name, req.Scopes, req.Days)
+	if err != nil {
+		r.fail(http.StatusBadRequest, "invalid_body", err.Error())
+		return
+	}
+	r.respond(http.StatusCreated, &apiTokenCreated{Token: token, apiTokenInfo: *newAPITokenInfo(t)})
+}
+
+// apiRevokeToken revokes a token of the admin, owners can revoke tokens of all admins.
+func apiRevokeToken(r *apiRequest) {
+	var t orm.APIToken
+	db.Where("id = ?", r.param("id")).First(&t)
+	if t.ID == 0 || (t.Admin != r.admin.Username && r.admin.Role != roleOwner) {
+		r.notFound("token")
+		return
+	}
+	if t.Revoked == 0 {
+		db.Table(orm.APIToken{}.TableName()).Where("id = ?", t.ID).Update("revoked", time.Now().Unix())
+	}
+	r.respond(http.StatusNoContent, nil)
+}
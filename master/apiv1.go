@@ -0,0 +1,647 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/asaskevich/govalidator"
+
+	"github.com/arkbriar/ssmgr/master/orm"
+)
+
+type apiUser struct {
+	ID        string `json:"id"`
+	Email     string `json:"email"`
+	Group     string `json:"group"`
+	Locale    string `json:"locale"`
+	Created   int64  `json:"created"`
+	Expires   int64  `json:"expires"`
+	QuotaFlow int64  `json:"quotaFlow"`
+	// UsedFlow is counted in the current quota period of the group.
+	UsedFlow    int64 `json:"usedFlow"`
+	Disabled    bool  `json:"disabled"`
+	HasPassword bool  `json:"hasPassword"`
+}
+
+type apiUserCreate struct {
+	Email  string `json:"email"`
+	Group  string `json:"group"`
+	Locale string `json:"locale"`
+}
+
+// apiUserUpdate changes the fields which are set.
+type apiUserUpdate struct {
+	Group    *string `json:"group"`
+	Disabled *bool   `json:"disabled"`
+}
+
+type apiSuspension struct {
+	// Minutes to suspend the user for, 0 means until resumed.
+	Minutes int64 `json:"minutes"`
+}
+
+type apiAllocation struct {
+	UserID         string `json:"userId"`
+	SlaveID        string `json:"slaveId"`
+	Port           int    `json:"port"`
+	Password       string `json:"password"`
+	Method         string `json:"method"`
+	Suspended      bool   `json:"suspended"`
+	SuspendedUntil int64  `json:"suspendedUntil"`
+}
+
+type apiGroup struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name"`
+	Slaves []string `json:"slaves"`
+	// FlowLimit is in MB and TimeLimit in hours, as in config.json.
+	FlowLimit int64    `json:"flowLimit"`
+	TimeLimit int64    `json:"timeLimit"`
+	ACLs      []string `json:"acls"`
+	// QuotaPeriod is "day", "week" or "month", empty if the quota is for the lifetime of users.
+	QuotaPeriod string `json:"quotaPeriod"`
+	ResetDay    int    `json:"resetDay"`
+	Timezone    string `json:"timezone"`
+	// Method is the encrypt method of the ports of the group, empty for the default one.
+	Method string `json:"method"`
+}
+
+// apiGroupUpdate changes the fields given of a group.
+type apiGroupUpdate struct {
+	Name        *string   `json:"name"`
+	Slaves      *[]string `json:"slaves"`
+	FlowLimit   *int64    `json:"flowLimit"`
+	TimeLimit   *int64    `json:"timeLimit"`
+	ACLs        *[]string `json:"acls"`
+	QuotaPeriod *string   `json:"quotaPeriod"`
+	ResetDay    *int      `json:"resetDay"`
+	Timezone    *string   `json:"timezone"`
+	Method      *string   `json:"method"`
+}
+
+type apiSlave struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Host        string   `json:"host"`
+	Port        int      `json:"port"`
+	PortMin     int      `json:"portMin"`
+	PortMax     int      `json:"portMax"`
+	Endpoints   []string `json:"endpoints"`
+	Allocations int64    `json:"allocations"`
+}
+
+type apiSlaveUsage struct {
+	SlaveID string `json:"slaveId"`
+	Flow    int64  `json:"flow"`
+}
+
+type apiUserUsage struct {
+	UserID string           `json:"userId"`
+	Flow   int64            `json:"flow"`
+	Slaves []*apiSlaveUsage `json:"slaves,omitempty"`
+}
+
+var apiRoutes []*apiRoute
+
+func init() {
+	apiRoutes = []*apiRoute{
+		{Method: "GET", Path: "/openapi.json", Summary: "OpenAPI document of this API",
+			Handle: func(r *apiRequest) { r.respond(http.StatusOK, openAPISpec()) }},
+
+		{Method: "GET", Path: "/users", Summary: "List users", Scope: "users:read", Paginated: true,
+			Query: []apiParam{
+				{"group", "string", "Only users in the group."},
+				{"state", "string", "Only active, suspended or disabled users."},
+				{"disabled", "boolean", "Only disabled or enabled users."},
+				{"email", "string", "Only users whose email contains it."},
+				{"expires_before", "integer", "Only users expiring before the time."},
+				{"usage_above", "number", "Only users who used more than the percentage of their quota."},
+				{"sort", "string", "Sort by email, group, created, expires, quota, used or usage, created by default."},
+				{"order", "string", "asc or desc, desc by default."},
+			},
+			Response: apiUser{}, Handle: apiListUsers},
+		{Method: "POST", Path: "/users", Summary: "Create a user", Scope: "users:write",
+			Body: apiUserCreate{}, Response: apiUser{}, Status: http.StatusCreated, Handle: apiCreateUser},
+		{Method: "GET", Path: "/users/{id}", Summary: "Get a user", Scope: "users:read",
+			Response: apiUser{}, Handle: apiGetUser},
+		{Method: "PATCH", Path: "/users/{id}", Summary: "Change the group of a user, or disable or enable it", Scope: "users:write",
+			Body: apiUserUpdate{}, Response: apiUser{}, Handle: apiUpdateUser},
+		{Method: "DELETE", Path: "/users/{id}", Summary: "Disable a user, users are kept with their flow records", Scope: "users:write",
+			Status: http.StatusNoContent, Handle: apiDeleteUser},
+		{Method: "PUT", Path: "/users/{id}/suspension", Summary: "Suspend all ports of a user", Scope: "users:write",
+			Body: apiSuspension{}, Status: http.StatusNoContent, Handle: apiSuspendUser},
+		{Method: "DELETE", Path: "/users/{id}/suspension", Summary: "Resume the ports of a suspended user", Scope: "users:write",
+			Status: http.StatusNoContent, Handle: apiResumeUser},
+		{Method: "GET", Path: "/users/{id}/allocations", Summary: "List the allocations of a user", Scope: "users:read",
+			Response: []apiAllocation{}, Handle: apiUserAllocations},
+		{Method: "GET", Path: "/users/{id}/usage", Summary: "Flow of a user on each slave", Scope: "users:read",
+			Response: apiUserUsage{}, Handle: apiUserUsageOf},
+		{Method: "GET", Path: "/users/{id}/usage/series", Summary: "Flow of a user in each hour or day, on every server and in total", Scope: "users:read",
+			Query: []apiParam{
+				{"range", "string", "24h, 7d, 30d or 90d ending now, or use from and to."},
+				{"from", "integer", "Beginning of the range."},
+				{"to", "integer", "End of the range, now by default."},
+				{"period", "string", "hour or day, chosen from the length of the range by default."},
+			},
+			Response: usageSeriesResult{}, Handle: apiUserUsageSeries},
+
+		{Method: "GET", Path: "/allocations", Summary: "List allocations", Scope: "users:read", Paginated: true,
+			Query: []apiParam{
+				{"user_id", "string", "Only allocations of the user."},
+				{"slave_id", "string", "Only allocations on the slave."},
+			},
+			Response: apiAllocation{}, Handle: apiListAllocations},
+		{Method: "GET", Path: "/usage", Summary: "Flow of users, most first", Scope: "users:read", Paginated: true,
+			Response: apiUserUsage{}, Handle: apiListUsage},
+
+		{Method: "GET", Path: "/groups", Summary: "List groups", Scope: "settings:read",
+			Response: []apiGroup{}, Handle: apiListGroups},
+		{Method: "POST", Path: "/groups", Summary: "Create a group", Scope: "settings:write",
+			Body: apiGroup{}, Response: apiGroup{}, Status: http.StatusCreated, Handle: apiCreateGroup},
+		{Method: "GET", Path: "/groups/{id}", Summary: "Get a group", Scope: "settings:read",
+			Response: apiGroup{}, Handle: apiGetGroup},
+		{Method: "PATCH", Path: "/groups/{id}", Summary: "Change a group, the changes are applied to the ports of its users", Scope: "settings:write",
+			Body: apiGroupUpdate{}, Response: apiGroup{}, Handle: apiUpdateGroup},
+		{Method: "DELETE", Path: "/groups/{id}", Summary: "Delete a group after moving its users to another group", Scope: "settings:write",
+			Query: []apiParam{
+				{"move_to", "string", "The group users are moved to, required."},
+			},
+			Status: http.StatusNoContent, Handle: apiDeleteGroup},
+		{Method: "GET", Path: "/slaves", Summary: "List slaves", Scope: "settings:read",
+			Response: []apiSlave{}, Handle: apiListSlaves},
+		{Method: "GET", Path: "/slaves/{id}", Summary: "Get a slave", Scope: "settings:read",
+			Response: apiSlave{}, Handle: apiGetSlave},
+
+		{Method: "GET", Path: "/tokens", Summary: "List API tokens of the admin, or of all admins for owners", SessionOnly: true,
+			Response: []apiTokenInfo{}, Handle: apiListTokens},
+		{Method: "POST", Path: "/tokens", Summary: "Create an API token, which is only shown once", SessionOnly: true,
+			Body: apiTokenRequest{}, Response: apiTokenCreated{}, Status: http.StatusCreated, Handle: apiCreateToken},
+		{Method: "DELETE", Path: "/tokens/{id}", Summary: "Revoke an API token", SessionOnly: true,
+			Status: http.StatusNoContent, Handle: apiRevokeToken},
+	}
+}
+
+// getAPIUser returns the user, or responds with an error if it's not found.
+func getAPIUser(r *apiRequest, id string) *apiUser {
+	users, err := queryUsers(&userFilter{ID: id})
+	if err != nil {
+		r.fail(http.StatusInternalServerError, "internal", err.Error())
+		return nil
+	}
+	if len(users) == 0 {
+		r.notFound("user " + id)
+		return nil
+	}
+	return users[0]
+}
+
+func apiListUsers(r *apiRequest) {
+	f := &userFilter{
+		Group: r.query("group"),
+		State: r.query("state"),
+		Email: r.query("email"),
+		Sort:  r.query("sort"),
+		Order: r.query("order"),
+	}
+	if disabled := r.query("disabled"); len(disabled) != 0 {
+		b, err := strconv.ParseBool(disabled)
+		if err != nil {
+			r.fail(http.StatusBadRequest, "invalid_query", "disabled must be true or false")
+			return
+		}
+		f.Disabled = &b
+	}
+	if expires := r.query("expires_before"); len(expires) != 0 {
+		t, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil {
+			r.fail(http.StatusBadRequest, "invalid_query", "expires_before must be a unix time")
+			return
+		}
+		f.ExpiresBefore = t
+	}
+	if usage := r.query("usage_above"); len(usage) != 0 {
+		p, err := strconv.ParseFloat(usage, 64)
+		if err != nil {
+			r.fail(http.StatusBadRequest, "invalid_query", "usage_above must be a number")
+			return
+		}
+		f.UsageAbove = p
+	}
+	f.Page, f.PerPage = r.pagination()
+
+	users, err := queryUsers(f)
+	if err != nil {
+		r.fail(http.StatusBadRequest, "invalid_query", err.Error())
+		return
+	}
+	total, err := countUsers(f)
+	if err != nil {
+		r.fail(http.StatusInternalServerError, "internal", err.Error())
+		return
+	}
+	r.respond(http.StatusOK, &apiPage{Items: users, Page: f.Page, PerPage: f.PerPage, Total: total})
+}
+
+func apiGetUser(r *apiRequest) {
+	if u := getAPIUser(r, r.param("id")); u != nil {
+		r.respond(http.StatusOK, u)
+	}
+}
+
+func apiCreateUser(r *apiRequest) {
+	var req apiUserCreate
+	if !r.readBody(&req) {
+		return
+	}
+	if !govalidator.IsEmail(req.Email) {
+		r.fail(http.StatusBadRequest, "invalid_body", "email is invalid")
+		return
+	}
+	if len(req.Group) != 0 && !HasGroup(req.Group) {
+		r.fail(http.StatusBadRequest, "invalid_body", "group "+req.Group+" not found")
+		return
+	}
+	if len(req.Locale) == 0 {
+		req.Locale = defaultLocale
+	}
+
+	var count int
+	db.Model(&orm.User{}).Where("email = ? AND disabled = 0", req.Email).Count(&count)
+	if count > 0 {
+		r.fail(http.StatusConflict, "conflict", "an enabled user with the email exists")
+		return
+	}
+
+	user := CreateUser(req.Email, req.Locale)
+	if len(req.Group) != 0 && req.Group != user.Group {
+		if err := ChangeUserGroup(user.ID, req.Group); err != nil {
+			r.fail(http.StatusInternalServerError, "internal", err.Error())
+			return
+		}
+	}
+	if u := getAPIUser(r, user.ID); u != nil {
+		r.respond(http.StatusCreated, u)
+	}
+}
+
+func apiUpdateUser(r *apiRequest) {
+	id := r.param("id")
+	var req apiUserUpdate
+	if !r.readBody(&req) {
+		return
+	}
+	if getAPIUser(r, id) == nil {
+		return
+	}
+
+	if req.Group != nil {
+		if !HasGroup(*req.Group) {
+			r.fail(http.StatusBadRequest, "invalid_body", "group "+*req.Group+" not found")
+			return
+		}
+		if err := ChangeUserGroup(id, *req.Group); err != nil {
+			r.fail(http.StatusInternalServerError, "internal", err.Error())
+			return
+		}
+	}
+	if req.Disabled != nil {
+		if *req.Disabled {
+			RemoveUser("", id)
+		} else {
+			EnableUser(id)
+		}
+	}
+
+	if u := getAPIUser(r, id); u != nil {
+		r.respond(http.StatusOK, u)
+	}
+}
+
+func apiDeleteUser(r *apiRequest) {
+	id := r.param("id")
+	if getAPIUser(r, id) == nil {
+		return
+	}
+	RemoveUser("", id)
+	r.respond(http.StatusNoContent, nil)
+}
+
+func apiSuspendUser(r *apiRequest) {
+	id := r.param("id")
+	var req apiSuspension
+	if !r.readBody(&req) {
+		return
+	}
+	if getAPIUser(r, id) == nil {
+		return
+	}
+
+	var until int64
+	if req.Minutes > 0 {
+		until = time.Now().Add(time.Duration(req.Minutes) * time.Minute).Unix()
+	}
+	go SuspendUser(until, id)
+	r.respond(http.StatusNoContent, nil)
+}
+
+func apiResumeUser(r *apiRequest) {
+	id := r.param("id")
+	if getAPIUser(r, id) == nil {
+		return
+	}
+	go ResumeUser(id)
+	r.respond(http.StatusNoContent, nil)
+}
+
+func newAPIAllocation(alloc *orm.Allocation, method string) *apiAllocation {
+	return &apiAllocation{
+		UserID:         alloc.UserID,
+		SlaveID:        alloc.ServerID,
+		Port:           alloc.Port,
+		Password:       alloc.Password,
+		Method:         method,
+		Suspended:      alloc.Suspended,
+		SuspendedUntil: alloc.SuspendedUntil,
+	}
+}
+
+func apiUserAllocations(r *apiRequest) {
+	id := r.param("id")
+	user := getAPIUser(r, id)
+	if user == nil {
+		return
+	}
+
+	var allocs []orm.Allocation
+	db.Table(orm.Allocation{}.TableName()).Where("user_id = ?", id).Order("server_id").Scan(&allocs)
+	method := methodOfGroup(user.Group)
+	items := make([]*apiAllocation, 0, len(allocs))
+	for i := range allocs {
+		items = append(items, newAPIAllocation(&allocs[i], method))
+	}
+	r.respond(http.StatusOK, items)
+}
+
+func apiListAllocations(r *apiRequest) {
+	query := db.Table(orm.Allocation{}.TableName())
+	if userID := r.query("user_id"); len(userID) != 0 {
+		query = query.Where("user_id = ?", userID)
+	}
+	if slaveID := r.query("slave_id"); len(slaveID) != 0 {
+		query = query.Where("server_id = ?", slaveID)
+	}
+
+	page, perPage := r.pagination()
+	var total int64
+	query.Count(&total)
+
+	var allocs []orm.Allocation
+	query.Order("user_id, server_id").Limit(perPage).Offset((page - 1) * perPage).Scan(&allocs)
+
+	// methods are of the groups of the users
+	userIDs := make([]string, 0, len(allocs))
+	for _, alloc := range allocs {
+		userIDs = append(userIDs, alloc.UserID)
+	}
+	var users []orm.User
+	if len(userIDs) > 0 {
+		db.Where("id IN (?)", userIDs).Find(&users)
+	}
+	groupOf := make(map[string]string)
+	for _, user := range users {
+		groupOf[user.ID] = user.Group
+	}
+
+	items := make([]*apiAllocation, 0, len(allocs))
+	for i := range allocs {
+		items = append(items, newAPIAllocation(&allocs[i], methodOfGroup(groupOf[allocs[i].UserID])))
+	}
+	r.respond(http.StatusOK, &apiPage{Items: items, Page: page, PerPage: perPage, Total: total})
+}
+
+func apiUserUsageOf(r *apiRequest) {
+	id := r.param("id")
+	if getAPIUser(r, id) == nil {
+		return
+	}
+
+	var slaves []*apiSlaveUsage
+	db.Raw("SELECT server_id AS slave_id, SUM(flow) AS flow FROM flow_record WHERE user_id = ? GROUP BY server_id ORDER BY server_id", id).
+		Scan(&slaves)
+	usage := &apiUserUsage{UserID: id, Slaves: make([]*apiSlaveUsage, 0, len(slaves))}
+	for _, s := range slaves {
+		usage.Flow += s.Flow
+		usage.Slaves = append(usage.Slaves, s)
+	}
+	r.respond(http.StatusOK, usage)
+}
+
+func apiListUsage(r *apiRequest) {
+	page, perPage := r.pagination()
+
+	var total struct{ Count int64 }
+	db.Raw("SELECT COUNT(DISTINCT user_id) AS count FROM flow_record").Scan(&total)
+
+	items := make([]*apiUserUsage, 0)
+	db.Raw("SELECT user_id, SUM(flow) AS flow FROM flow_record GROUP BY user_id ORDER BY flow DESC, user_id LIMIT ? OFFSET ?",
+		perPage, (page-1)*perPage).Scan(&items)
+	r.respond(http.StatusOK, &apiPage{Items: items, Page: page, PerPage: perPage, Total: total.Count})
+}
+
+func newAPIGroup(group *Group) *apiGroup {
+	g := &apiGroup{
+		ID:        group.Config.ID,
+		Name:      group.Config.Name,
+		Slaves:    group.Config.SlaveIDs,
+		FlowLimit: group.Config.Limit.Flow,
+		TimeLimit: group.Config.Limit.Time,
+		ACLs:      group.Config.ACLs,
+
+		QuotaPeriod: group.Config.Limit.Period,
+		ResetDay:    group.Config.Limit.ResetDay,
+		Timezone:    group.quota.location.String(),
+		Method:      group.Config.Method,
+	}
+	if g.Slaves == nil {
+		g.Slaves = []string{}
+	}
+	if g.ACLs == nil {
+		g.ACLs = []string{}
+	}
+	return g
+}
+
+func apiListGroups(r *apiRequest) {
+	all := allGroups()
+	items := make([]*apiGroup, 0, len(all))
+	for _, group := range all {
+		items = append(items, newAPIGroup(group))
+	}
+	r.respond(http.StatusOK, items)
+}
+
+func apiGetGroup(r *apiRequest) {
+	group := getGroup(r.param("id"))
+	if group == nil {
+		r.notFound("group " + r.param("id"))
+		return
+	}
+	r.respond(http.StatusOK, newAPIGroup(group))
+}
+
+// respondGroup saves the group and responds with it.
+func respondGroup(r *apiRequest, status int, c *GroupConfig) {
+	if err := saveGroup(c); err != nil {
+		r.fail(http.StatusBadRequest, "invalid_body", err.Error())
+		return
+	}
+	r.respond(status, newAPIGroup(getGroup(c.ID)))
+}
+
+func apiCreateGroup(r *apiRequest) {
+	var req apiGroup
+	if !r.readBody(&req) {
+		return
+	}
+	if HasGroup(req.ID) {
+		r.fail(http.StatusConflict, "conflict", "group "+req.ID+" exists")
+		return
+	}
+
+	c := &GroupConfig{
+		ID:       req.ID,
+		Name:     req.Name,
+		SlaveIDs: req.Slaves,
+		Method:   req.Method,
+		ACLs:     req.ACLs,
+	}
+	c.Limit.Flow = req.FlowLimit
+	c.Limit.Time = req.TimeLimit
+	c.Limit.Period = req.QuotaPeriod
+	c.Limit.ResetDay = req.ResetDay
+	c.Limit.Timezone = req.Timezone
+	respondGroup(r, http.StatusCreated, c)
+}
+
+func apiUpdateGroup(r *apiRequest) {
+	var req apiGroupUpdate
+	if !r.readBody(&req) {
+		return
+	}
+	group := getGroup(r.param("id"))
+	if group == nil {
+		r.notFound("group " + r.param("id"))
+		return
+	}
+
+	c := *group.Config
+	if req.Name != nil {
+		c.Name = *req.Name
+	}
+	if req.Slaves != nil {
+		c.SlaveIDs = *req.Slaves
+	}
+	if req.FlowLimit != nil {
+		c.Limit.Flow = *req.FlowLimit
+	}
+	if req.TimeLimit != nil {
+		c.Limit.Time = *req.TimeLimit
+	}
+	if req.ACLs != nil {
+		c.ACLs = *req.ACLs
+	}
+	if req.QuotaPeriod != nil {
+		c.Limit.Period = *req.QuotaPeriod
+	}
+	if req.ResetDay != nil {
+		c.Limit.ResetDay = *req.ResetDay
+	}
+	if req.Timezone != nil {
+		c.Limit.Timezone = *req.Timezone
+	}
+	if req.Method != nil {
+		c.Method = *req.Method
+	}
+	respondGroup(r, http.StatusOK, &c)
+}
+
+func apiDeleteGroup(r *apiRequest) {
+	id, moveTo := r.param("id"), r.query("move_to")
+	if !HasGroup(id) {
+		r.notFound("group " + id)
+		return
+	}
+	if len(moveTo) == 0 {
+		r.fail(http.StatusBadRequest, "invalid_query", "move_to is required")
+		return
+	}
+	if moveTo == id || !HasGroup(moveTo) {
+		r.fail(http.StatusBadRequest, "invalid_query", "move_to must be another group")
+		return
+	}
+	if id == "default" {
+		r.fail(http.StatusConflict, "conflict", "group default can't be deleted")
+		return
+	}
+	if b := budgetOfFreeGroup(id); b != "" {
+		r.fail(http.StatusConflict, "conflict", "group "+id+" is a free group of the "+b)
+		return
+	}
+
+	if err := deleteGroup(id, moveTo); err != nil {
+		r.fail(http.StatusInternalServerError, "internal", err.Error())
+		return
+	}
+	r.respond(http.StatusNoContent, nil)
+}
+
+// apiSlaves returns the slaves sorted by id, with the number of ports allocated on each.
+func apiSlaves() []*apiSlave {
+	var allocs []struct {
+		ServerID string
+		Count    int64
+	}
+	db.Table(orm.Allocation{}.TableName()).Select("server_id, count(*) AS count").Group("server_id").Scan(&allocs)
+	allocated := make(map[string]int64)
+	for _, a := range allocs {
+		allocated[a.ServerID] = a.Count
+	}
+
+	ids := make([]string, 0, len(slaves))
+	for id := range slaves {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	items := make([]*apiSlave, 0, len(ids))
+	for _, id := range ids {
+		c := slaves[id].Config
+		items = append(items, &apiSlave{
+			ID:          c.ID,
+			Name:        c.Name,
+			Host:        c.Host,
+			Port:        c.Port,
+			PortMin:     c.PortMin,
+			PortMax:     c.PortMax,
+			Endpoints:   c.AdvertisedEndpoints(),
+			Allocations: allocated[id],
+		})
+	}
+	return items
+}
+
+func apiListSlaves(r *apiRequest) {
+	r.respond(http.StatusOK, apiSlaves())
+}
+
+func apiGetSlave(r *apiRequest) {
+	for _, s := range apiSlaves() {
+		if s.ID == r.param("id") {
+			r.respond(http.StatusOK, s)
+			return
+		}
+	}
+	r.notFound("slave " + r.param("id"))
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/arkbriar/ssmgr/master/orm"
+)
+
+// Actions taken when a budget runs out, until the period ends.
+const (
+	budgetStopSignups  = "stop_signups"
+	budgetThrottleFree = "throttle_free"
+	budgetStopFree     = "stop_free"
+)
+
+var defaultBudgetAlerts = []float64{0.8, 0.95}
+
+// BudgetConfig limits the traffic of all slaves, or of a slave, in a day, week or month.
+type BudgetConfig struct {
+	// Slave is the slave whose traffic is counted, all slaves if it's empty.
+	Slave string `json:"slave,omitempty"`
+	// Period is "day", "week" or "month", beginning on ResetDay in Timezone as quota periods of
+	// groups.
+	Period   string `json:"period"`
+	ResetDay int    `json:"resetDay,omitempty"`
+	Timezone string `json:"timezone,omitempty"`
+	Flow     int64  `json:"flow"` // MB
+	// Alerts are the ratios of the budget used at which admins are alerted, 0.8 and 0.95 by
+	// default.
+	Alerts []float64 `json:"alerts,omitempty"`
+	// Action is "stop_signups", "throttle_free" or "stop_free", taken when ActionAt (1 by
+	// default) of the budget is used. Nothing is done but alerting if it's empty.
+	Action   string  `json:"action,omitempty"`
+	ActionAt float64 `json:"actionAt,omitempty"`
+	// FreeGroups are the groups throttled or stopped, "default" by default.
+	FreeGroups []string `json:"freeGroups,omitempty"`
+	// ThrottleFlow is the flow in MB each user of the free groups can use on the slave in the
+	// period when it's throttled, users using more are suspended until the period ends.
+	ThrottleFlow int64 `json:"throttleFlow,omitempty"`
+}
+
+// budget is the state of a budget in the current period.
+type budget struct {
+	Config *BudgetConfig
+	period *calendarPeriod
+
+	start, end int64
+	// alerted is the highest ratio alerted in the period.
+	alerted float64
+	// exceeded is set when the action is taken, until the period ends.
+	exceeded bool
+}
+
+var (
+	budgets   []*budget
+	budgetsMu sync.Mutex
+)
+
+func (b *budget) String() string {
+	if len(b.Config.Slave) == 0 {
+		return b.Config.Period + " budget of all slaves"
+	}
+	return b.Config.Period + " budget of slave " + b.Config.Slave
+}
+
+// InitBudgets checks the budgets in config.
+func InitBudgets() {
+	for i, c := range config.Budgets {
+		b, err := newBudget(c)
+		if err != nil {
+			logrus.Fatalf("Invalid budget %d: %s", i, err.Error())
+		}
+		budgets = append(budgets, b)
+	}
+}
+
+func newBudget(c *BudgetConfig) (*budget, error) {
+	if len(c.Period) == 0 {
+		return nil, errors.New("period is required")
+	}
+	period, err := newCalendarPeriod(c.Period, c.ResetDay, c.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.Slave) != 0 && slaves[c.Slave] == nil {
+		return nil, fmt.Errorf("slave '%s' not found", c.Slave)
+	}
+	if c.Flow <= 0 {
+		return nil, errors.New("flow must be positive")
+	}
+
+	switch c.Action {
+	case "", budgetStopSignups, budgetStopFree:
+	case budgetThrottleFree:
+		if c.ThrottleFlow <= 0 {
+			return nil, errors.New("throttleFlow is required to throttle free groups")
+		}
+	default:
+		return nil, fmt.Errorf("unknown action '%s', it must be stop_signups, throttle_free or stop_free", c.Action)
+	}
+	if c.Alerts == nil {
+		c.Alerts = defaultBudgetAlerts
+	}
+	if c.ActionAt == 0 {
+		c.ActionAt = 1
+	}
+	if len(c.FreeGroups) == 0 {
+		c.FreeGroups = []string{"default"}
+	}
+	for _, id := range c.FreeGroups {
+		if !HasGroup(id) {
+			return nil, fmt.Errorf("group '%s' not found", id)
+		}
+	}
+	return &budget{Config: c, period: period}, nil
+}
+
+// budgetFlow returns the flow on the slave, or on all slaves, since start.
+func budgetFlow(serverID string, start int64) int64 {
+	var flowSum []struct{ Flow int64 }
+	query := "SELECT sum(flow) AS flow FROM usage_snapshot WHERE period = ? AND start >= ?"
+	args := []interface{}{usageHour, start}
+	if len(serverID) != 0 {
+		query += " AND server_id = ?"
+		args = append(args, serverID)
+	}
+	db.Raw(query, args...).Scan(&flowSum)
+	if len(flowSum) == 0 {
+		return 0
+	}
+	return flowSum[0].Flow
+}
+
+// checkBudgets counts the flow of budgets in their periods, alerts admins when thresholds are
+// reached, and takes the actions of the budgets running out.
+func checkBudgets() {
+	budgetsMu.Lock()
+	defer budgetsMu.Unlock()
+
+	now := time.Now()
+	for _, b := range budgets {
+		start, end := b.period.bounds(now)
+		if start != b.start {
+			if b.exceeded {
+				logrus.Infof("The %s is reset", b)
+			}
+			b.alerted, b.exceeded = 0, false
+		}
+		b.start, b.end = start, end
+		used := budgetFlow(b.Config.Slave, start)
+
+		limit := b.Config.Flow * 1024 * 1024
+		ratio := float64(used) / float64(limit)
+		budgetUsage.WithLabelValues(b.Config.Slave, b.Config.Period).Set(ratio)
+
+		// only the highest threshold reached is alerted
+		var reached float64
+		for _, alert := range b.Config.Alerts {
+			if ratio >= alert && alert > reached {
+				reached = alert
+			}
+		}
+		if reached > b.alerted {
+			logrus.Warnf("%.0f%% of the %s is used, %s of %s", reached*100, b, formatFlow(used), formatFlow(limit))
+			b.alerted = reached
+		}
+
+		if len(b.Config.Action) == 0 || ratio < b.Config.ActionAt {
+			continue
+		}
+		if !b.exceeded {
+			logrus.Warnf("The %s runs out, %s until %s", b, b.Config.Action, time.Unix(end, 0).Format("2006-01-02 15:04"))
+			b.exceeded = true
+		}
+		switch b.Config.Action {
+		case budgetStopFree, budgetThrottleFree:
+			b.suspendFree()
+		}
+	}
+}
+
+// suspendFree suspends the allocations of free groups on the slave of the budget, until the
+// period ends. Only the users using more than ThrottleFlow are suspended if it's throttled.
+// Allocations are checked in every monitoring loop, so that new ones are suspended too.
+func (b *budget) suspendFree() {
+	query := "SELECT allocation.* FROM allocation JOIN users ON users.id = allocation.user_id " +
+		"WHERE users.`group` IN (?) AND users.disabled = 0 AND allocation.suspended = 0"
+	args := []interface{}{b.Config.FreeGroups}
+	if len(b.Config.Slave) != 0 {
+		query += " AND allocation.server_id = ?"
+		args = append(args, b.Config.Slave)
+	}
+	if b.Config.Action == budgetThrottleFree {
+		query += ` AND (SELECT COALESCE(SUM(usage_snapshot.flow), 0) FROM usage_snapshot
+WHERE usage_snapshot.user_id = allocation.user_id AND usage_snapshot.period = ? AND usage_snapshot.start >= ?`
+		args = append(args, usageHour, b.start)
+		if len(b.Config.Slave) != 0 {
+			query += " AND usage_snapshot.server_id = allocation.server_id"
+		}
+		query += ") >= ?"
+		args = append(args, b.Config.ThrottleFlow*1024*1024)
+	}
+
+	var allocs []orm.Allocation
+	if err := db.Raw(query, args...).Scan(&allocs).Error; err != nil {
+		logrus.Errorf("Failed to query allocations of the %s: %s", b, err.Error())
+		return
+	}
+	if len(allocs) > 0 {
+		logrus.Infof("Suspend %d allocations of free groups for the %s", len(allocs), b)
+		suspendAllocations(b.end, allocs...)
+	}
+}
+
+// budgetOfFreeGroup returns the budget the group is a free group of, empty if there's none.
+func budgetOfFreeGroup(groupID string) string {
+	budgetsMu.Lock()
+	defer budgetsMu.Unlock()
+
+	for _, b := range budgets {
+		for _, id := range b.Config.FreeGroups {
+			if id == groupID {
+				return b.String()
+			}
+		}
+	}
+	return ""
+}
+
+// signupsStopped tells whether new users can't sign up, with the period of the budget stopping
+// them.
+func signupsStopped() (string, bool) {
+	budgetsMu.Lock()
+	defer budgetsMu.Unlock()
+
+	for _, b := range budgets {
+		if b.exceeded && b.Config.Action == budgetStopSignups {
+			return b.Config.Period, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	masterCertFile = "master.crt"
+	masterKeyFile  = "master.key"
+	masterName     = "master"
+)
+
+// slaveBundleConfig is the config file of slave written in the bundle.
+type slaveBundleConfig struct {
+	Port    int    `json:"port"`
+	MgrPort int    `json:"manager_port"`
+	Token   string `json:"token"`
+	TLS     struct {
+		CertFile   string `json:"cert_file"`
+		KeyFile    string `json:"key_file"`
+		CAFile     string `json:"ca_file"`
+		MasterName string `json:"master_name"`
+	} `json:"tls"`
+}
+
+// caDir returns the directory of the built-in CA.
+func caDir() string {
+	if len(config.CADir) != 0 {
+		return config.CADir
+	}
+	return filepath.Join(filepath.Dir(*configPath), "ca")
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func findSlaveConfig(id string) *SlaveConfig {
+	for _, info := range config.Slaves {
+		if info.ID == id {
+			return info
+		}
+	}
+	return nil
+}
+
+// ensureMasterCredentials issues the client certificate of master with the built-in CA if TLS is
+// not configured, and returns the common name slaves should pin.
+func ensureMasterCredentials(ca *CA) (string, error) {
+	if config.TLS == nil {
+		certPEM, keyPEM, err := ca.Issue(masterName, nil, true, caExpiryDays)
+		if err != nil {
+			return "", err
+		}
+		certPath, keyPath := filepath.Join(caDir(), masterCertFile), filepath.Join(caDir(), masterKeyFile)
+		if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+			return "", err
+		}
+		if err := ioutil.WriteFile(certPath, certPEM, 0644); err != nil {
+			return "", err
+		}
+		config.TLS = &struct {
+			CAFile   string `json:"caFile"`
+			CertFile string `json:"certFile"`
+			KeyFile  string `json:"keyFile"`
+		}{
+			CAFile:   filepath.Join(caDir(), caCertFile),
+			CertFile: certPath,
+			KeyFile:  keyPath,
+		}
+
+		logrus.Infof("Issued client certificate of master: %s", certPath)
+
+		return masterName, nil
+	}
+
+	// slaves only trust the built-in CA, so the configured certificate must be signed by it
+	certPEM, err := ioutil.ReadFile(config.TLS.CertFile)
+	if err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return "", errors.New("no certificate found in " + config.TLS.CertFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca.CertPEM())
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:     pool,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return "", fmt.Errorf("certificate of master is not signed by the built-in CA: %s", err)
+	}
+	return cert.Subject.CommonName, nil
+}
+
+func writeBundle(dir, installDir string, bundle *slaveBundleConfig, caPEM, certPEM, keyPEM []byte) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	bundle.TLS.CAFile = filepath.Join(installDir, caCertFile)
+	bundle.TLS.CertFile = filepath.Join(installDir, "server.crt")
+	bundle.TLS.KeyFile = filepath.Join(installDir, "server.key")
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	files := []struct {
+		name string
+		data []byte
+		perm os.FileMode
+	}{
+		{caCertFile, caPEM, 0644},
+		{"server.crt", certPEM, 0644},
+		{"server.key", keyPEM, 0600},
+		{"config.slave.json", data, 0600},
+	}
+	for _, f := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, f.name), f.data, f.perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runEnroll issues the credentials of a slave, writes its config bundle and registers it in the
+// config of master.
+func runEnroll(args []string) error {
+	fs := flag.NewFlagSet("enroll", flag.ExitOnError)
+	var (
+		host       = fs.String("host", "", "Public address of the slave (required)")
+		name       = fs.String("name", "", "Display name of the slave, defaults to its id")
+		port       = fs.Int("port", 6001, "Grpc port of the slave")
+		mgrPort    = fs.Int("manager-port", 6001, "Shadowsocks manager api port of the slave")
+		portMin    = fs.Int("port-min", 20000, "Lowest port allocated to users")
+		portMax    = fs.Int("port-max", 20500, "Highest port allocated to users")
+		output     = fs.String("o", "", "Directory to write the bundle, defaults to ./<slave-id>")
+		installDir = fs.String("install-dir", "/etc/ssmgr", "Directory the bundle is installed to on the slave")
+		days       = fs.Int("days", 825, "Days before the certificate of the slave expires")
+		force      = fs.Bool("force", false, "Issue new credentials for a slave already enrolled")
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-c config] enroll [options] <slave-id>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("slave id is required")
+	}
+	id := fs.Arg(0)
+	if len(*host) == 0 {
+		return errors.New("-host is required")
+	}
+	if len(*name) == 0 {
+		*name = id
+	}
+	if len(*output) == 0 {
+		*output = id
+	}
+
+	info := findSlaveConfig(id)
+	if info != nil && !*force {
+		return fmt.Errorf("slave %s is already enrolled, use -force to issue new credentials", id)
+	}
+
+	ca, err := LoadOrCreateCA(caDir())
+	if err != nil {
+		return err
+	}
+	pinnedMaster, err := ensureMasterCredentials(ca)
+	if err != nil {
+		return err
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+	// the slave id is added as a DNS name, so master can pin the certificate to this slave
+	certPEM, keyPEM, err := ca.Issue(id, []string{*host, id}, false, *days)
+	if err != nil {
+		return err
+	}
+
+	bundle := &slaveBundleConfig{
+		Port:    *port,
+		MgrPort: *mgrPort,
+		Token:   token,
+	}
+	bundle.TLS.MasterName = pinnedMaster
+	if err := writeBundle(*output, *installDir, bundle, ca.CertPEM(), certPEM, keyPEM); err != nil {
+		return err
+	}
+
+	if info == nil {
+		info = &SlaveConfig{ID: id}
+		config.Slaves = append(config.Slaves, info)
+	}
+	info.Name = *name
+	info.Host = *host
+	info.Port = *port
+	info.Token = token
+	info.PortMin = *portMin
+	info.PortMax = *portMax
+	info.ServerName = id
+	if err := saveConfig(); err != nil {
+		return err
+	}
+
+	logrus.Infof("Slave %s enrolled, copy %s to %s on the slave", id, *output, *installDir)
+
+	return nil
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/kataras/iris"
+
+	"github.com/arkbriar/ssmgr/master/orm"
+)
+
+// exportUser is the part of a user templates can render, templates are edited by admins and must
+// not reach credentials of users.
+type exportUser struct {
+	ID        string
+	Email     string
+	Group     string
+	QuotaFlow int64
+	Expired   int64
+}
+
+// exportData is what exporters render for a user.
+type exportData struct {
+	User    *exportUser
+	Servers []*subscriptionServer
+	// Server is the server selected by the "server" param, for clients taking only one server.
+	Server         *subscriptionServer
+	BytesUsed      int64
+	BytesRemaining int64
+}
+
+// Exporter renders the servers of a user into the configuration of a client.
+type Exporter interface {
+	// ContentType is the MIME type of the rendered configuration.
+	ContentType() string
+	Export(w io.Writer, data *exportData) error
+}
+
+var exporters = make(map[string]Exporter)
+
+// RegisterExporter makes an exporter available as a format of subscriptions.
+func RegisterExporter(format string, e Exporter) {
+	exporters[format] = e
+}
+
+// exportFormats returns the names of all registered formats.
+func exportFormats() []string {
+	formats := make([]string, 0, len(exporters))
+	for format := range exporters {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// exporterFunc adapts a function to an Exporter.
+type exporterFunc struct {
+	contentType string
+	export      func(w io.Writer, data *exportData) error
+}
+
+func (e *exporterFunc) ContentType() string {
+	return e.contentType
+}
+
+func (e *exporterFunc) Export(w io.Writer, data *exportData) error {
+	return e.export(w, data)
+}
+
+// templateExporter renders a text template, which can be replaced by admins.
+type templateExporter struct {
+	format          string
+	contentType     string
+	defaultTemplate string
+}
+
+func (e *templateExporter) ContentType() string {
+	return e.contentType
+}
+
+// Template returns the template edited by admins, or the default one.
+func (e *templateExporter) Template() string {
+	var tpl orm.ExportTemplate
+	db.Where("format = ?", e.format).First(&tpl)
+	if len(tpl.Template) != 0 {
+		return tpl.Template
+	}
+	return e.defaultTemplate
+}
+
+func (e *templateExporter) Export(w io.Writer, data *exportData) error {
+	tpl, err := parseExportTemplate(e.format, e.Template())
+	if err != nil {
+		return err
+	}
+	return tpl.Execute(w, data)
+}
+
+var exportFuncs = template.FuncMap{
+	// quote quotes a string for JSON and YAML
+	"quote": strconv.Quote,
+	// name removes the characters separating fields in INI style configurations
+	"name": func(s string) string {
+		return strings.NewReplacer(",", " ", "=", " ", "\n", " ").Replace(s)
+	},
+}
+
+func parseExportTemplate(format, text string) (*template.Template, error) {
+	return template.New(format).Funcs(exportFuncs).Parse(text)
+}
+
+const clashTemplate = `proxies:
+{{- range .Servers}}
+  - name: {{quote .Remarks}}
+    type: ss
+    server: {{quote .Host}}
+    port: {{.Port}}
+    cipher: {{.Method}}
+    password: {{quote .Password}}
+    udp: true
+{{- end}}
+proxy-groups:
+  - name: Proxy
+    type: select
+    proxies:
+{{- range .Servers}}
+      - {{quote .Remarks}}
+{{- end}}
+rules:
+  - MATCH,Proxy
+`
+
+const surgeTemplate = `[Proxy]
+{{- range .Servers}}
+{{name .Remarks}} = ss, {{.Host}}, {{.Port}}, encrypt-method={{.Method}}, password={{.Password}}, udp-relay=true
+{{- end}}
+
+[Proxy Group]
+Proxy = select{{range .Servers}}, {{name .Remarks}}{{end}}
+`
+
+const quantumultXTemplate = `{{range .Servers -}}
+shadowsocks={{.HostPort}}, method={{.Method}}, password={{.Password}}, udp-relay=true, tag={{name .Remarks}}
+{{end}}`
+
+const ssLocalTemplate = `{{with .Server -}}
+{
+  "server": {{quote .Host}},
+  "server_port": {{.Port}},
+  "local_address": "127.0.0.1",
+  "local_port": 1080,
+  "password": {{quote .Password}},
+  "method": {{quote .Method}},
+  "timeout": 300
+}
+{{end}}`
+
+const ssRedirTemplate = `{{with .Server -}}
+{
+  "server": {{quote .Host}},
+  "server_port": {{.Port}},
+  "local_address": "0.0.0.0",
+  "local_port": 1080,
+  "password": {{quote .Password}},
+  "method": {{quote .Method}},
+  "timeout": 300,
+  "mode": "tcp_and_udp"
+}
+{{end}}`
+
+func exportSIP002(w io.Writer, data *exportData) error {
+	uris := make([]string, 0, len(data.Servers))
+	for _, s := range data.Servers {
+		uris = append(uris, s.sip002())
+	}
+	_, err := io.WriteString(w, base64.StdEncoding.EncodeToString([]byte(strings.Join(uris, "\n"))))
+	return err
+}
+
+func exportSIP008(w io.Writer, data *exportData) error {
+	type sip008Server struct {
+		ID         string `json:"id"`
+		Remarks    string `json:"remarks"`
+		Server     string `json:"server"`
+		ServerPort int    `json:"server_port"`
+		Password   string `json:"password"`
+		Method     string `json:"method"`
+	}
+	type sip008 struct {
+		Version        int             `json:"version"`
+		Servers        []*sip008Server `json:"servers"`
+		BytesUsed      int64           `json:"bytes_used,omitempty"`
+		BytesRemaining int64           `json:"bytes_remaining,omitempty"`
+	}
+
+	resp := &sip008{
+		Version:        1,
+		Servers:        make([]*sip008Server, 0, len(data.Servers)),
+		BytesUsed:      data.BytesUsed,
+		BytesRemaining: data.BytesRemaining,
+	}
+	for _, s := range data.Servers {
+		resp.Servers = append(resp.Servers, &sip008Server{
+			ID:         s.ID,
+			Remarks:    s.Remarks,
+			Server:     s.Host,
+			ServerPort: s.Port,
+			Password:   s.Password,
+			Method:     s.Method,
+		})
+	}
+	return json.NewEncoder(w).Encode(resp)
+}
+
+func init() {
+	RegisterExporter("sip002", &exporterFunc{"text/plain; charset=utf-8", exportSIP002})
+	RegisterExporter("sip008", &exporterFunc{"application/json", exportSIP008})
+	RegisterExporter("clash", &templateExporter{"clash", "text/yaml; charset=utf-8", clashTemplate})
+	RegisterExporter("surge", &templateExporter{"surge", "text/plain; charset=utf-8", surgeTemplate})
+	RegisterExporter("quantumult-x", &templateExporter{"quantumult-x", "text/plain; charset=utf-8", quantumultXTemplate})
+	RegisterExporter("ss-local", &templateExporter{"ss-local", "application/json", ssLocalTemplate})
+	RegisterExporter("ss-redir", &templateExporter{"ss-redir", "application/json", ssRedirTemplate})
+}
+
+// newExportData collects the servers and traffic of the user.
+func newExportData(user *orm.User) *exportData {
+	data := &exportData{
+		User: &exportUser{
+			ID:        user.ID,
+			Email:     user.Email,
+			Group:     user.Group,
+			QuotaFlow: user.QuotaFlow,
+			Expired:   user.Expired,
+		},
+		Servers: subscriptionServers(user.ID),
+	}
+
+	data.BytesUsed = quotaFlowOf(user, time.Now())
+	if user.QuotaFlow > data.BytesUsed {
+		data.BytesRemaining = user.QuotaFlow - data.BytesUsed
+	}
+	return data
+}
+
+// sampleExportData is rendered to check the templates edited by admins.
+func sampleExportData() *exportData {
+	server := &subscriptionServer{
+		ID:       serverUUID("sample"),
+		Remarks:  "Sample",
+		Host:     "203.0.113.1",
+		Port:     20000,
+		Password: "password",
+		Method:   shadowsocksMethod,
+	}
+	return &exportData{
+		User:    &exportUser{ID: "sample", Email: "sample@example.com", Group: "default"},
+		Servers: []*subscriptionServer{server},
+		Server:  server,
+	}
+}
+
+// handleExportTemplate returns the templates of all editable formats.
+func handleExportTemplate(ctx *iris.Context) {
+	if !requirePermission(ctx, permSettingsRead) {
+		return
+	}
+
+	type templateInfo struct {
+		Format   string `json:"format"`
+		Template string `json:"template"`
+		Default  string `json:"default"`
+	}
+	templates := make([]*templateInfo, 0)
+	for _, format := range exportFormats() {
+		if e, ok := exporters[format].(*templateExporter); ok {
+			templates = append(templates, &templateInfo{
+				Format:   format,
+				Template: e.Template(),
+				Default:  e.defaultTemplate,
+			})
+		}
+	}
+	ctx.JSON(iris.StatusOK, templates)
+}
+
+// handleExportTemplatePut replaces the template of a format, an empty template restores the
+// default one.
+func handleExportTemplatePut(ctx *iris.Context) {
+	if !requirePermission(ctx, permSettingsWrite) {
+		return
+	}
+
+	var req struct {
+		Format   string `json:"format"`
+		Template string `json:"template"`
+	}
+	if err := ctx.ReadJSON(&req); err != nil {
+		panic(err.Error())
+	}
+	if _, ok := exporters[req.Format].(*templateExporter); !ok {
+		ctx.WriteString("format " + req.Format + " is not editable")
+		return
+	}
+
+	if len(req.Template) == 0 {
+		db.Where("format = ?", req.Format).Delete(&orm.ExportTemplate{})
+		ctx.WriteString("success")
+		return
+	}
+
+	tpl, err := parseExportTemplate(req.Format, req.Template)
+	if err == nil {
+		err = tpl.Execute(ioutil.Discard, sampleExportData())
+	}
+	if err != nil {
+		ctx.WriteString(err.Error())
+		return
+	}
+
+	db.Where("format = ?", req.Format).Delete(&orm.ExportTemplate{})
+	db.Create(&orm.ExportTemplate{Format: req.Format, Template: req.Template})
+	ctx.WriteString("success")
+}
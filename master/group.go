@@ -1,40 +1,354 @@
 package main
 
-import "github.com/Sirupsen/logrus"
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/arkbriar/ssmgr/master/orm"
+)
 
 type Group struct {
 	Config *GroupConfig
+	// quota is the period the flow quota is reset in.
+	quota *calendarPeriod
 }
 
-var groups map[string]*Group
-var defaultGroup *Group
+// Groups are replaced but never changed in place once they're in groups, so a group got from
+// getGroup can be used without locks.
+var (
+	groups   map[string]*Group
+	groupsMu sync.RWMutex
+)
+
+// shadowsocksMethods are the encrypt methods supported by slaves.
+var shadowsocksMethods = []string{
+	"table", "rc4", "rc4-md5", "aes-128-cfb", "aes-192-cfb", "aes-256-cfb",
+	"aes-128-ctr", "aes-192-ctr", "aes-256-ctr", "bf-cfb", "camellia-128-cfb",
+	"camellia-192-cfb", "camellia-256-cfb", "cast5-cfb", "des-cfb", "idea-cfb",
+	"rc2-cfb", "seed-cfb", "salsa20", "chacha20", "chacha20-ietf",
+}
 
+// InitGroups loads groups from database. On the first start, groups in config.json are moved
+// into database.
 func InitGroups() {
-	groups = make(map[string]*Group)
+	var count int
+	db.Model(&orm.Group{}).Count(&count)
+	if count == 0 {
+		for _, c := range config.Groups {
+			if err := db.Create(groupRecord(c)).Error; err != nil {
+				logrus.Fatalf("Failed to create group '%s' from config: %s", c.ID, err.Error())
+			}
+		}
+		logrus.Infof("Created %d groups from config.json", len(config.Groups))
+	} else if len(config.Groups) != 0 {
+		logrus.Warn("Groups in config.json are ignored, since groups are in database already")
+	}
+	if len(config.Groups) != 0 {
+		config.Groups = nil
+		if err := saveConfig(); err != nil {
+			logrus.Warnf("Failed to save config: %s", err.Error())
+		}
+	}
 
-	for _, config := range config.Groups {
-		groups[config.ID] = &Group{
-			Config: config,
+	var records []orm.Group
+	db.Find(&records)
+	groups = make(map[string]*Group)
+	for i := range records {
+		group, err := newGroup(groupConfigOf(&records[i]))
+		if err != nil {
+			logrus.Fatalf("Invalid group '%s': %s", records[i].ID, err.Error())
 		}
+		groups[group.Config.ID] = group
 	}
 
-	defaultGroup = groups["default"]
-	if defaultGroup == nil {
+	if groups["default"] == nil {
 		logrus.Fatal("Group 'default' is required")
 	}
 }
 
-// GetGroupIDs returns all groups' ids.
+func groupRecord(c *GroupConfig) *orm.Group {
+	return &orm.Group{
+		ID:       c.ID,
+		Name:     c.Name,
+		Slaves:   strings.Join(c.SlaveIDs, ","),
+		Flow:     c.Limit.Flow,
+		Time:     c.Limit.Time,
+		Period:   c.Limit.Period,
+		ResetDay: c.Limit.ResetDay,
+		Timezone: c.Limit.Timezone,
+		Method:   c.Method,
+		ACLs:     strings.Join(c.ACLs, ","),
+	}
+}
+
+func splitList(s string) []string {
+	if len(s) == 0 {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func groupConfigOf(r *orm.Group) *GroupConfig {
+	c := &GroupConfig{
+		ID:       r.ID,
+		Name:     r.Name,
+		SlaveIDs: splitList(r.Slaves),
+		Method:   r.Method,
+		ACLs:     splitList(r.ACLs),
+	}
+	c.Limit.Flow = r.Flow
+	c.Limit.Time = r.Time
+	c.Limit.Period = r.Period
+	c.Limit.ResetDay = r.ResetDay
+	c.Limit.Timezone = r.Timezone
+	return c
+}
+
+// newGroup checks the config of the group. Slaves and ACLs not found are warned only, so that
+// master still starts after they're removed from config.json.
+func newGroup(c *GroupConfig) (*Group, error) {
+	if len(c.ID) == 0 || strings.Contains(c.ID, ",") {
+		return nil, errors.New("id is required, and can't contain commas")
+	}
+	if len(c.Name) == 0 {
+		return nil, errors.New("name is required")
+	}
+	if c.Limit.Flow < 0 || c.Limit.Time < 0 {
+		return nil, errors.New("flow and time can't be negative")
+	}
+	if len(c.Method) != 0 {
+		valid := false
+		for _, m := range shadowsocksMethods {
+			valid = valid || m == c.Method
+		}
+		if !valid {
+			return nil, fmt.Errorf("unknown method '%s'", c.Method)
+		}
+	}
+	for _, id := range c.SlaveIDs {
+		if slaves[id] == nil {
+			logrus.Warnf("Slave '%s' of group '%s' not found", id, c.ID)
+		}
+	}
+	quota, err := newCalendarPeriod(c.Limit.Period, c.Limit.ResetDay, c.Limit.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	return &Group{Config: c, quota: quota}, nil
+}
+
+// Method returns the encrypt method of the allocations of the group.
+func (g *Group) Method() string {
+	if len(g.Config.Method) == 0 {
+		return shadowsocksMethod
+	}
+	return g.Config.Method
+}
+
+// getGroup returns the group, or nil if it's not found.
+func getGroup(id string) *Group {
+	groupsMu.RLock()
+	defer groupsMu.RUnlock()
+	return groups[id]
+}
+
+// methodOfGroup returns the encrypt method of the group, or the default one if it's not found.
+func methodOfGroup(id string) string {
+	if group := getGroup(id); group != nil {
+		return group.Method()
+	}
+	return shadowsocksMethod
+}
+
+// GetGroupIDs returns all groups' ids, sorted.
 func GetGroupIDs() []string {
-	ids := make([]string, 0)
-	for id, _ := range groups {
+	groupsMu.RLock()
+	defer groupsMu.RUnlock()
+	return sortedGroupIDs()
+}
+
+func sortedGroupIDs() []string {
+	ids := make([]string, 0, len(groups))
+	for id := range groups {
 		ids = append(ids, id)
 	}
+	sort.Strings(ids)
 	return ids
 }
 
+// allGroups returns all groups, sorted by id.
+func allGroups() []*Group {
+	groupsMu.RLock()
+	defer groupsMu.RUnlock()
+
+	all := make([]*Group, 0, len(groups))
+	for _, id := range sortedGroupIDs() {
+		all = append(all, groups[id])
+	}
+	return all
+}
+
 // HasGroup returns if group exists
 func HasGroup(id string) bool {
-	_, ok := groups[id]
-	return ok
+	return getGroup(id) != nil
+}
+
+// saveGroup creates or updates the group, and applies the changes to the users in it and their
+// allocations in background.
+func saveGroup(c *GroupConfig) error {
+	for _, id := range c.SlaveIDs {
+		if slaves[id] == nil {
+			return fmt.Errorf("slave '%s' not found", id)
+		}
+	}
+	aclMu.RLock()
+	for _, name := range c.ACLs {
+		if _, ok := findACL(name); !ok {
+			aclMu.RUnlock()
+			return fmt.Errorf("acl '%s' not found", name)
+		}
+	}
+	aclMu.RUnlock()
+	group, err := newGroup(c)
+	if err != nil {
+		return err
+	}
+
+	groupsMu.Lock()
+	defer groupsMu.Unlock()
+	old := groups[c.ID]
+	if old == nil {
+		err = db.Create(groupRecord(c)).Error
+	} else {
+		err = db.Save(groupRecord(c)).Error
+	}
+	if err != nil {
+		return err
+	}
+	groups[c.ID] = group
+
+	if old != nil {
+		logrus.Infof("Group '%s' is updated", c.ID)
+		go applyGroupChanges(old, group)
+	} else {
+		logrus.Infof("Group '%s' is created", c.ID)
+	}
+	return nil
+}
+
+// applyGroupChanges updates the limits of the users in the group, frees their ports on the
+// slaves removed from the group, and allocates their ports again to apply the slaves, quota and
+// method. Users disabled for quota or expiry are enabled if the new limits allow. Users over the
+// new limits are disabled, and ACLs are rolled out, by the monitoring loop.
+func applyGroupChanges(old, group *Group) {
+	id := group.Config.ID
+	limit, oldLimit := group.Config.Limit, old.Config.Limit
+
+	if limit.Flow != oldLimit.Flow || limit.Time != oldLimit.Time {
+		err := db.Exec("UPDATE users SET quota_flow = ?, expired = time + ? WHERE `group` = ?",
+			limit.Flow*1024*1024, limit.Time*3600, id).Error
+		if err != nil {
+			logrus.Errorf("Failed to update limits of users in group '%s': %s", id, err.Error())
+		}
+	}
+
+	kept := make(map[string]bool)
+	for _, serverID := range group.Config.SlaveIDs {
+		kept[serverID] = true
+	}
+	var removed []string
+	for _, serverID := range old.Config.SlaveIDs {
+		if !kept[serverID] {
+			removed = append(removed, serverID)
+		}
+	}
+	if len(removed) > 0 {
+		var allocs []orm.Allocation
+		db.Raw("SELECT * FROM allocation WHERE server_id IN (?) AND user_id IN (SELECT id FROM users WHERE `group` = ?)",
+			removed, id).Scan(&allocs)
+		for _, alloc := range allocs {
+			db.Where("user_id = ? AND server_id = ?", alloc.UserID, alloc.ServerID).Delete(&orm.Allocation{})
+			if err := FreeAllocation(alloc.ServerID, alloc.Port); err != nil {
+				logrus.Errorf("Failed to free ports for %s: %s", alloc.UserID, err.Error())
+			}
+		}
+	}
+
+	if limit == oldLimit && group.Method() == old.Method() && len(removed) == 0 &&
+		len(group.Config.SlaveIDs) == len(old.Config.SlaveIDs) {
+		return
+	}
+	var users []orm.User
+	db.Where("`group` = ? AND disabled = 0", id).Find(&users)
+	for _, user := range users {
+		// allocating again updates the quota and method of the ports, suspended ports are
+		// suspended again by the monitoring loop
+		allocateForUser(user.ID, id)
+	}
+	logrus.Infof("Changes of group '%s' are applied to %d users", id, len(users))
+
+	if limit.Flow > oldLimit.Flow || limit.Time > oldLimit.Time || limit.Period != oldLimit.Period {
+		enableWithinLimits(id)
+	}
+}
+
+// enableWithinLimits enables the users in the group disabled for quota or expiry, if they're
+// within their limits now.
+func enableWithinLimits(groupID string) {
+	now := time.Now()
+	var users []orm.User
+	db.Where("`group` = ? AND disabled = 1 AND disabled_reason IN (?)", groupID, []string{"quota", "expired"}).Find(&users)
+	for i := range users {
+		user := &users[i]
+		if user.Expired <= now.Unix() {
+			continue
+		}
+		if user.QuotaFlow > 0 && quotaFlowOf(user, now) >= user.QuotaFlow {
+			continue
+		}
+		logrus.Infof("User %s is within the new limits of group '%s'", user.ID, groupID)
+		EnableUser(user.ID)
+	}
+}
+
+// deleteGroup deletes the group after moving its users to another group.
+func deleteGroup(id, moveTo string) error {
+	if id == "default" {
+		return errors.New("group 'default' can't be deleted")
+	}
+	if id == moveTo {
+		return errors.New("users can't be moved to the group deleted")
+	}
+	if !HasGroup(id) {
+		return fmt.Errorf("group '%s' not found", id)
+	}
+	if !HasGroup(moveTo) {
+		return fmt.Errorf("group '%s' not found", moveTo)
+	}
+	if b := budgetOfFreeGroup(id); b != "" {
+		return fmt.Errorf("group '%s' is a free group of the %s", id, b)
+	}
+
+	var users []orm.User
+	db.Where("`group` = ?", id).Find(&users)
+	for _, user := range users {
+		if err := ChangeUserGroup(user.ID, moveTo); err != nil {
+			return err
+		}
+	}
+
+	groupsMu.Lock()
+	defer groupsMu.Unlock()
+	if err := db.Where("id = ?", id).Delete(&orm.Group{}).Error; err != nil {
+		return err
+	}
+	delete(groups, id)
+	logrus.Infof("Group '%s' is deleted, %d users are moved to '%s'", id, len(users), moveTo)
+	return nil
 }
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/asaskevich/govalidator"
+	"github.com/jinzhu/gorm"
+	"github.com/kataras/iris"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/arkbriar/ssmgr/master/orm"
+)
+
+const (
+	minPasswordLength = 8
+	// bcrypt ignores the bytes after the 72nd.
+	maxPasswordLength = 72
+	// maxFailedLogins is the number of wrong passwords in a row before the user is locked.
+	maxFailedLogins = 5
+	loginLockout    = 15 * time.Minute
+)
+
+// dummyPasswordHash is compared when the user has no password, so that failed logins take the
+// same time whether the email is registered or not.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("ssmgr"), bcrypt.DefaultCost)
+
+// checkVerifyCode checks the code sent to the email, which is valid for verifyCodeExpire seconds.
+func checkVerifyCode(email, code string) bool {
+	var records []orm.VerifyCode
+	timeFrom := time.Now().Add(-verifyCodeExpire * time.Second).Unix()
+	db.Where("email = ? AND code = ? AND time > ?", email, code, timeFrom).Find(&records)
+	return len(records) != 0
+}
+
+// unlockLogin clears the failed logins of the user or admin identified by key in the table.
+func unlockLogin(table, keyColumn, key string) {
+	db.Table(table).Where(keyColumn+" = ?", key).Updates(map[string]interface{}{
+		"failed_logins": 0,
+		"locked_until":  0,
+	})
+}
+
+// recordFailedLogin counts a wrong password of the user or admin identified by key in the table,
+// and locks it when there are too many of them.
+func recordFailedLogin(table, keyColumn, key string) {
+	db.Table(table).Where(keyColumn+" = ?", key).Update("failed_logins", gorm.Expr("failed_logins + 1"))
+	locked := db.Table(table).Where(keyColumn+" = ? AND failed_logins >= ?", key, maxFailedLogins).
+		Updates(map[string]interface{}{
+			"failed_logins": 0,
+			"locked_until":  time.Now().Add(loginLockout).Unix(),
+		})
+	if locked.RowsAffected > 0 {
+		logrus.Warnf("%s %s is locked after %d failed logins", table, key, maxFailedLogins)
+	}
+}
+
+// handleLogin logs in the user with email and password. The user is locked for loginLockout
+// after maxFailedLogins wrong passwords, and can still log in with a verify code.
+func handleLogin(ctx *iris.Context) {
+	var request struct {
+		Email    string `json:"email" valid:"email"`
+		Password string `json:"password" valid:"-"`
+	}
+	if err := ctx.ReadJSON(&request); err != nil {
+		panic(err.Error())
+	}
+	if _, err := govalidator.ValidateStruct(&request); err != nil {
+		ctx.WriteString(err.Error())
+		return
+	}
+
+	var user orm.User
+	db.Where("email = ? AND disabled = 0", request.Email).First(&user)
+
+	now := time.Now().Unix()
+	if user.LockedUntil > now {
+		ctx.SetStatusCode(iris.StatusForbidden)
+		ctx.WriteString("too many failed logins, try again later or login with a verify code")
+		return
+	}
+
+	hash := dummyPasswordHash
+	if len(user.PasswordHash) != 0 {
+		hash = []byte(user.PasswordHash)
+	}
+	err := bcrypt.CompareHashAndPassword(hash, []byte(request.Password))
+	if err != nil || len(user.PasswordHash) == 0 {
+		if len(user.PasswordHash) != 0 {
+			recordFailedLogin("users", "id", user.ID)
+		}
+		ctx.SetStatusCode(iris.StatusForbidden)
+		ctx.WriteString("login failed")
+		return
+	}
+
+	if user.FailedLogins != 0 {
+		unlockLogin("users", "id", user.ID)
+	}
+	ctx.Session().Set("user_id", user.ID)
+	ctx.WriteString(user.ID)
+}
+
+// handleAccountPassword sets the password of the user logged in. A forgotten password is reset
+// with a verify code sent to the email, which also logs in the user.
+func handleAccountPassword(ctx *iris.Context) {
+	var request struct {
+		Email    string `json:"email" valid:"email,optional"`
+		Code     string `json:"code" valid:"length(6|6),optional"`
+		Password string `json:"password" valid:"-"`
+	}
+	if err := ctx.ReadJSON(&request); err != nil {
+		panic(err.Error())
+	}
+	if _, err := govalidator.ValidateStruct(&request); err != nil {
+		ctx.WriteString(err.Error())
+		return
+	}
+	if len(request.Password) < minPasswordLength || len(request.Password) > maxPasswordLength {
+		ctx.SetStatusCode(iris.StatusBadRequest)
+		ctx.WriteString("password must be 8 to 72 characters")
+		return
+	}
+
+	var user orm.User
+	if len(request.Code) != 0 {
+		if !checkVerifyCode(request.Email, request.Code) {
+			ctx.SetStatusCode(iris.StatusForbidden)
+			ctx.WriteString("wrong verify code")
+			return
+		}
+		db.Where("email = ? AND disabled = 0", request.Email).First(&user)
+		if user.ID == "" {
+			ctx.SetStatusCode(iris.StatusNotFound)
+			ctx.WriteString("user not found")
+			return
+		}
+		// The code can't be used again to reset the password
+		db.Where("email = ? AND code = ?", request.Email, request.Code).Delete(&orm.VerifyCode{})
+		ctx.Session().Set("user_id", user.ID)
+	} else {
+		userID := ctx.Session().GetString("user_id")
+		if len(userID) != 0 {
+			db.Where("id = ?", userID).First(&user)
+		}
+		if user.ID == "" {
+			ctx.SetStatusCode(iris.StatusUnauthorized)
+			ctx.WriteString("please login first")
+			return
+		}
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(request.Password), bcrypt.DefaultCost)
+	if err != nil {
+		panic(err.Error())
+	}
+	db.Table("users").Where("id = ?", user.ID).Updates(map[string]interface{}{
+		"password_hash": string(hash),
+		"failed_logins": 0,
+		"locked_until":  0,
+	})
+	logrus.Infof("Password of user %s is set", user.ID)
+	ctx.WriteString("success")
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	netmail "net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/kataras/iris"
+
+	"github.com/arkbriar/ssmgr/master/orm"
+)
+
+// Status of mails in the outbox.
+const (
+	mailQueued  = "queued"
+	mailSent    = "sent"
+	mailFailed  = "failed"
+	mailExpired = "expired"
+)
+
+const (
+	// mailMaxAttempts is the number of attempts before a mail is given up.
+	mailMaxAttempts = 8
+	// mailRetryDelay is the delay after the first failure, it doubles on each failure up to
+	// mailMaxRetryDelay.
+	mailRetryDelay    = 30 * time.Second
+	mailMaxRetryDelay = 2 * time.Hour
+	// mailQueueInterval is how often the outbox is checked for mails to retry.
+	mailQueueInterval = 10 * time.Second
+	mailBatchSize     = 50
+)
+
+// MailTransport delivers a MIME message.
+type MailTransport interface {
+	Send(from string, to []string, msg []byte) error
+}
+
+// smtpTransport sends mails through an SMTP server, STARTTLS is used if the server supports it.
+type smtpTransport struct {
+	addr string
+	auth smtp.Auth
+}
+
+func (t *smtpTransport) Send(from string, to []string, msg []byte) error {
+	return smtp.SendMail(t.addr, t.auth, from, to, msg)
+}
+
+// sendmailTransport pipes mails into a local sendmail compatible program.
+type sendmailTransport struct {
+	path string
+}
+
+func (t *sendmailTransport) Send(from string, to []string, msg []byte) error {
+	args := append([]string{"-i", "-f", from, "--"}, to...)
+	cmd := exec.Command(t.path, args...)
+	cmd.Stdin = bytes.NewReader(msg)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s", err.Error(), bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// maildirTransport delivers mails into a maildir instead of sending them, for tests and for
+// other programs to pick them up.
+type maildirTransport struct {
+	dir string
+	seq uint64
+}
+
+func (t *maildirTransport) Send(from string, to []string, msg []byte) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(t.dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+
+	host, _ := os.Hostname()
+	name := fmt.Sprintf("%d.%d_%d.%s", time.Now().UnixNano(), os.Getpid(), atomic.AddUint64(&t.seq, 1), host)
+	tmp := filepath.Join(t.dir, "tmp", name)
+	if err := ioutil.WriteFile(tmp, msg, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(t.dir, "new", name))
+}
+
+var (
+	mailTransport MailTransport
+	// mailWakeup triggers a delivery of the outbox without waiting for the interval.
+	mailWakeup = make(chan struct{}, 1)
+)
+
+// InitMail creates the mail transport, which is used by both web and monitoring.
+func InitMail() {
+	switch config.Email.Transport {
+	case "", "smtp":
+		var auth smtp.Auth
+		if len(config.Email.Username) != 0 {
+			auth = smtp.PlainAuth("", config.Email.Username, config.Email.Password, config.Email.Host)
+		}
+		mailTransport = &smtpTransport{
+			addr: fmt.Sprintf("%s:%d", config.Email.Host, config.Email.Port),
+			auth: auth,
+		}
+	case "sendmail":
+		path := config.Email.SendmailPath
+		if len(path) == 0 {
+			path = "/usr/sbin/sendmail"
+		}
+		mailTransport = &sendmailTransport{path: path}
+	case "maildir":
+		mailTransport = &maildirTransport{dir: config.Email.Maildir}
+	default:
+		logrus.Fatalf("Unknown mail transport: %s", config.Email.Transport)
+	}
+}
+
+// mailFrom returns the address in the From header, with the alias if it's configured.
+func mailFrom() string {
+	return (&netmail.Address{Name: config.Email.FromAlias, Address: config.Email.FromAddr}).String()
+}
+
+// newMessageID returns a unique Message-ID in the domain of the From address.
+func newMessageID() (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	domain := "localhost"
+	if addr, err := netmail.ParseAddress(config.Email.FromAddr); err == nil {
+		if i := strings.LastIndex(addr.Address, "@"); i >= 0 {
+			domain = addr.Address[i+1:]
+		}
+	}
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(id[:]), domain), nil
+}
+
+// buildMessage builds the MIME message of a mail in the outbox, dated at the time it's sent. It's
+// multipart/alternative if the mail has HTML.
+func buildMessage(mail *orm.OutboxMail, date time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", mailFrom())
+	fmt.Fprintf(&buf, "To: %s\r\n", mail.Recipient)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", mail.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: %s\r\n", mail.MessageID)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+
+	if len(mail.HTML) == 0 {
+		buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+		buf.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+		writeBase64(&buf, mail.Text)
+		return buf.Bytes(), nil
+	}
+
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", parts.Boundary())
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", mail.Text},
+		{"text/html; charset=utf-8", mail.HTML},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		var encoded bytes.Buffer
+		writeBase64(&encoded, part.content)
+		w.Write(encoded.Bytes())
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+	buf.Write(body.Bytes())
+	return buf.Bytes(), nil
+}
+
+// writeBase64 writes the content in base64 with lines of 76 characters.
+func writeBase64(buf *bytes.Buffer, content string) {
+	encoded := base64.StdEncoding.EncodeToString([]byte(content))
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	buf.WriteString(encoded + "\r\n")
+}
+
+// queueEmail renders the email in the locale and adds it to the outbox. A mail not delivered
+// before expires (unix time, 0 for never) is given up.
+func queueEmail(to, name, locale string, data interface{}, expires int64) error {
+	// the recipient is written into the headers, transports other than smtp don't check it
+	addr, err := netmail.ParseAddress(to)
+	if err != nil {
+		return fmt.Errorf("invalid recipient %q: %s", to, err)
+	}
+	email, err := renderEmail(name, locale, data)
+	if err != nil {
+		return err
+	}
+	messageID, err := newMessageID()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	mail := orm.OutboxMail{
+		Recipient:   addr.Address,
+		Name:        name,
+		Subject:     email.Subject,
+		Text:        email.Text,
+		HTML:        email.HTML,
+		MessageID:   messageID,
+		Status:      mailQueued,
+		NextAttempt: now,
+		Expires:     expires,
+		Created:     now,
+	}
+	if err := db.Create(&mail).Error; err != nil {
+		return err
+	}
+
+	select {
+	case mailWakeup <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// mailRetryAfter returns the delay before the next attempt of a mail failed for the times.
+func mailRetryAfter(attempts int) time.Duration {
+	delay := mailRetryDelay
+	for i := 1; i < attempts && delay < mailMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > mailMaxRetryDelay {
+		delay = mailMaxRetryDelay
+	}
+	return delay
+}
+
+// MailQueue delivers the mails in the outbox, and retries failed ones with backoff.
+func MailQueue() {
+	for {
+		if err := deliverMails(); err != nil {
+			logrus.Error("Deliver mails error: ", err.Error())
+		}
+		select {
+		case <-mailWakeup:
+		case <-time.After(mailQueueInterval):
+		}
+	}
+}
+
+func deliverMails() error {
+	var mails []orm.OutboxMail
+	err := db.Where("status = ? AND next_attempt <= ?", mailQueued, time.Now().Unix()).
+		Order("id").Limit(mailBatchSize).Find(&mails).Error
+	if err != nil {
+		return err
+	}
+
+	for _, mail := range mails {
+		updates := map[string]interface{}{}
+
+		now := time.Now()
+		if mail.Expires > 0 && now.Unix() > mail.Expires {
+			updates["status"] = mailExpired
+		} else if err := sendMail(&mail, now); err != nil {
+			attempts := mail.Attempts + 1
+			logrus.Warnf("Failed to send mail %d to %s (attempt %d): %s", mail.ID, mail.Recipient, attempts, err.Error())
+
+			updates["attempts"] = attempts
+			updates["last_error"] = err.Error()
+			if attempts >= mailMaxAttempts {
+				updates["status"] = mailFailed
+				logrus.Errorf("Gave up mail %d to %s after %d attempts", mail.ID, mail.Recipient, attempts)
+			} else {
+				updates["next_attempt"] = now.Add(mailRetryAfter(attempts)).Unix()
+			}
+		} else {
+			updates["attempts"] = mail.Attempts + 1
+			updates["status"] = mailSent
+			updates["sent"] = now.Unix()
+		}
+
+		if status, ok := updates["status"].(string); ok && mail.Name == emailVerify {
+			verifyEmails.WithLabelValues(status).Inc()
+		}
+		if err := db.Table(orm.OutboxMail{}.TableName()).Where("id = ?", mail.ID).Updates(updates).Error; err != nil {
+			logrus.Errorf("Failed to update mail %d: %s", mail.ID, err.Error())
+		}
+	}
+	return nil
+}
+
+// sendMail builds the message of the mail at now and sends it with the transport.
+func sendMail(mail *orm.OutboxMail, now time.Time) error {
+	msg, err := buildMessage(mail, now)
+	if err != nil {
+		return err
+	}
+	return mailTransport.Send(config.Email.FromAddr, []string{mail.Recipient}, msg)
+}
+
+// handleMail lists the mails in the outbox with the number of mails in each status. Messages are
+// not included.
+func handleMail(ctx *iris.Context) {
+	if !requirePermission(ctx, permSettingsRead) {
+		return
+	}
+
+	var req struct {
+		Status string `json:"status"`
+		Limit  int    `json:"limit"`
+		Offset int    `json:"offset"`
+	}
+	if err := ctx.ReadJSON(&req); err != nil {
+		panic(err.Error())
+	}
+	if req.Limit <= 0 || req.Limit > 500 {
+		req.Limit = 100
+	}
+
+	var counts []struct {
+		Status string
+		Count  int64
+	}
+	db.Raw("SELECT status, count(*) AS count FROM mail_outbox GROUP BY status").Scan(&counts)
+
+	type mailInfo struct {
+		ID          uint   `json:"id"`
+		Recipient   string `json:"recipient"`
+		Name        string `json:"name"`
+		Subject     string `json:"subject"`
+		Status      string `json:"status"`
+		Attempts    int    `json:"attempts"`
+		NextAttempt int64  `json:"nextAttempt"`
+		LastError   string `json:"lastError"`
+		Created     int64  `json:"created"`
+		Sent        int64  `json:"sent"`
+	}
+	query := db.Table(orm.OutboxMail{}.TableName()).
+		Select("id, recipient, name, subject, status, attempts, next_attempt, last_error, created, sent")
+	if len(req.Status) != 0 {
+		query = query.Where("status = ?", req.Status)
+	}
+	mails := make([]mailInfo, 0)
+	query.Order("id DESC").Limit(req.Limit).Offset(req.Offset).Scan(&mails)
+
+	resp := struct {
+		Counts map[string]int64 `json:"counts"`
+		Mails  []mailInfo       `json:"mails"`
+	}{make(map[string]int64), mails}
+	for _, c := range counts {
+		resp.Counts[c.Status] = c.Count
+	}
+	ctx.JSON(iris.StatusOK, resp)
+}
+
+// handleMailRetry queues a failed or expired mail again.
+func handleMailRetry(ctx *iris.Context) {
+	if !requirePermission(ctx, permSettingsWrite) {
+		return
+	}
+
+	var req struct {
+		ID uint `json:"id"`
+	}
+	if err := ctx.ReadJSON(&req); err != nil {
+		panic(err.Error())
+	}
+
+	result := db.Table(orm.OutboxMail{}.TableName()).
+		Where("id = ? AND status IN (?)", req.ID, []string{mailFailed, mailExpired}).
+		Updates(map[string]interface{}{
+			"status":       mailQueued,
+			"attempts":     0,
+			"next_attempt": time.Now().Unix(),
+			"expires":      0,
+		})
+	if result.Error != nil {
+		ctx.WriteString(result.Error.Error())
+		return
+	}
+	if result.RowsAffected == 0 {
+		ctx.WriteString("mail " + strconv.FormatUint(uint64(req.ID), 10) + " is not failed")
+		return
+	}
+
+	select {
+	case mailWakeup <- struct{}{}:
+	default:
+	}
+	ctx.WriteString("success")
+}
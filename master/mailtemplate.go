@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/kataras/iris"
+)
+
+// Names of emails.
+const (
+	emailVerify        = "verify"
+	emailQuotaWarning  = "quota_warning"
+	emailExpiryWarning = "expiry_warning"
+	emailDisabled      = "disabled"
+)
+
+var emailNames = []string{emailVerify, emailQuotaWarning, emailExpiryWarning, emailDisabled}
+
+const defaultLocale = "en"
+
+// Parts of an email, each is a template file named "<name>.<part>", e.g. "verify.subject".
+const (
+	partSubject = "subject"
+	partText    = "txt"
+	partHTML    = "html"
+)
+
+// builtinEmailTemplates are used when the template is not found in the template dir, indexed by
+// locale and file name.
+var builtinEmailTemplates = map[string]map[string]string{
+	"en": {
+		"verify.subject": `Your verify code`,
+		"verify.txt":     "Your verify code is {{.Code}}, it expires in {{.ExpireMinutes}} minutes.\n",
+		"verify.html":    `<p>Your verify code is <b>{{.Code}}</b>, it expires in {{.ExpireMinutes}} minutes.</p>`,
+
+		"quota_warning.subject": `You have used {{.Percent}}% of your traffic`,
+		"quota_warning.txt":     "You have used {{.Used}} of {{.Quota}} traffic. Your account will be disabled when it runs out.\n",
+		"quota_warning.html":    `<p>You have used <b>{{.Used}}</b> of {{.Quota}} traffic. Your account will be disabled when it runs out.</p>`,
+
+		"expiry_warning.subject": `Your account expires soon`,
+		"expiry_warning.txt":     "Your account expires at {{.ExpireTime}}. It will be disabled then.\n",
+		"expiry_warning.html":    `<p>Your account expires at <b>{{.ExpireTime}}</b>. It will be disabled then.</p>`,
+
+		"disabled.subject": `Your account has been disabled`,
+		"disabled.txt":     "Your account has been disabled, because {{if eq .Reason \"quota\"}}your traffic has run out{{else}}your account has expired{{end}}.\n",
+		"disabled.html":    `<p>Your account has been disabled, because {{if eq .Reason "quota"}}your traffic has run out{{else}}your account has expired{{end}}.</p>`,
+	},
+	"zh": {
+		"verify.subject": `您的验证码`,
+		"verify.txt":     "您的验证码是 {{.Code}}，{{.ExpireMinutes}} 分钟内有效。\n",
+		"verify.html":    `<p>您的验证码是 <b>{{.Code}}</b>，{{.ExpireMinutes}} 分钟内有效。</p>`,
+
+		"quota_warning.subject": `您已使用 {{.Percent}}% 的流量`,
+		"quota_warning.txt":     "您已使用 {{.Used}} / {{.Quota}} 流量，流量用尽后账号将被停用。\n",
+		"quota_warning.html":    `<p>您已使用 <b>{{.Used}}</b> / {{.Quota}} 流量，流量用尽后账号将被停用。</p>`,
+
+		"expiry_warning.subject": `您的账号即将到期`,
+		"expiry_warning.txt":     "您的账号将于 {{.ExpireTime}} 到期，届时将被停用。\n",
+		"expiry_warning.html":    `<p>您的账号将于 <b>{{.ExpireTime}}</b> 到期，届时将被停用。</p>`,
+
+		"disabled.subject": `您的账号已停用`,
+		"disabled.txt":     "您的账号已停用，原因是{{if eq .Reason \"quota\"}}流量已用尽{{else}}账号已到期{{end}}。\n",
+		"disabled.html":    `<p>您的账号已停用，原因是{{if eq .Reason "quota"}}流量已用尽{{else}}账号已到期{{end}}。</p>`,
+	},
+}
+
+// emailTemplateDir returns the directory of email templates, which has a sub directory for each
+// locale.
+func emailTemplateDir() string {
+	return config.Email.TemplateDir
+}
+
+// emailTemplate returns the template file of the locale, a file in the template dir overrides
+// the built-in one.
+func emailTemplate(locale, filename string) (string, bool) {
+	if dir := emailTemplateDir(); len(dir) != 0 {
+		data, err := ioutil.ReadFile(filepath.Join(dir, locale, filename))
+		if err == nil {
+			return string(data), true
+		}
+	}
+	text, ok := builtinEmailTemplates[locale][filename]
+	return text, ok
+}
+
+// emailLocales returns the locales having templates.
+func emailLocales() []string {
+	seen := make(map[string]bool)
+	for locale := range builtinEmailTemplates {
+		seen[locale] = true
+	}
+	if dir := emailTemplateDir(); len(dir) != 0 {
+		if infos, err := ioutil.ReadDir(dir); err == nil {
+			for _, info := range infos {
+				if info.IsDir() {
+					seen[info.Name()] = true
+				}
+			}
+		}
+	}
+
+	locales := make([]string, 0, len(seen))
+	for locale := range seen {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// matchLocale chooses the locale of emails from an Accept-Language header, by the quality of
+// languages and then by their order.
+func matchLocale(acceptLanguage string) string {
+	type language struct {
+		tag     string
+		quality float64
+	}
+	var languages []language
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		lang := language{tag: strings.ToLower(strings.TrimSpace(fields[0])), quality: 1}
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					lang.quality = q
+				}
+			}
+		}
+		if len(lang.tag) != 0 && lang.tag != "*" && lang.quality > 0 {
+			languages = append(languages, lang)
+		}
+	}
+	// insertion sort keeps the order of languages of the same quality
+	for i := 1; i < len(languages); i++ {
+		for j := i; j > 0 && languages[j].quality > languages[j-1].quality; j-- {
+			languages[j], languages[j-1] = languages[j-1], languages[j]
+		}
+	}
+
+	supported := make(map[string]string)
+	for _, locale := range emailLocales() {
+		supported[strings.ToLower(locale)] = locale
+	}
+	for _, lang := range languages {
+		if locale, ok := supported[lang.tag]; ok {
+			return locale
+		}
+		// "zh-CN" falls back to "zh"
+		if i := strings.Index(lang.tag, "-"); i > 0 {
+			if locale, ok := supported[lang.tag[:i]]; ok {
+				return locale
+			}
+		}
+	}
+	return defaultLocale
+}
+
+// renderedEmail is an email rendered from templates, HTML is empty if there's no template of it.
+type renderedEmail struct {
+	Subject string `json:"subject"`
+	Text    string `json:"text"`
+	HTML    string `json:"html"`
+}
+
+// renderEmail renders the email in the locale, the templates of the default locale are used
+// when the locale doesn't have them.
+func renderEmail(name, locale string, data interface{}) (*renderedEmail, error) {
+	lookup := func(part string) (string, bool) {
+		filename := name + "." + part
+		if text, ok := emailTemplate(locale, filename); ok {
+			return text, true
+		}
+		return emailTemplate(defaultLocale, filename)
+	}
+
+	var email renderedEmail
+	for _, part := range []string{partSubject, partText, partHTML} {
+		text, ok := lookup(part)
+		if !ok {
+			if part == partHTML {
+				continue
+			}
+			return nil, os.ErrNotExist
+		}
+
+		var buf bytes.Buffer
+		if part == partHTML {
+			tpl, err := htmltemplate.New(name).Parse(text)
+			if err != nil {
+				return nil, err
+			}
+			if err := tpl.Execute(&buf, data); err != nil {
+				return nil, err
+			}
+			email.HTML = buf.String()
+			continue
+		}
+
+		tpl, err := texttemplate.New(name).Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		if err := tpl.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		if part == partSubject {
+			email.Subject = strings.TrimSpace(buf.String())
+		} else {
+			email.Text = buf.String()
+		}
+	}
+	return &email, nil
+}
+
+// sampleEmailData is rendered in previews of templates.
+var sampleEmailData = map[string]map[string]interface{}{
+	emailVerify:        {"Email": "user@example.com", "Code": "123456", "ExpireMinutes": verifyCodeExpire / 60},
+	emailQuotaWarning:  {"Email": "user@example.com", "Percent": 80, "Used": "800.00 MB", "Quota": "1000.00 MB"},
+	emailExpiryWarning: {"Email": "user@example.com", "ExpireTime": "2017-01-01 00:00"},
+	emailDisabled:      {"Email": "user@example.com", "Reason": "quota"},
+}
+
+// handleEmailTemplate lists the emails and locales having templates.
+func handleEmailTemplate(ctx *iris.Context) {
+	if !requirePermission(ctx, permSettingsRead) {
+		return
+	}
+
+	ctx.JSON(iris.StatusOK, map[string][]string{
+		"names":   emailNames,
+		"locales": emailLocales(),
+	})
+}
+
+// handleEmailPreview renders an email with sample data.
+func handleEmailPreview(ctx *iris.Context) {
+	if !requirePermission(ctx, permSettingsRead) {
+		return
+	}
+
+	var req struct {
+		Name   string `json:"name"`
+		Locale string `json:"locale"`
+	}
+	if err := ctx.ReadJSON(&req); err != nil {
+		panic(err.Error())
+	}
+	data, ok := sampleEmailData[req.Name]
+	if !ok {
+		ctx.WriteString("email " + req.Name + " not found")
+		return
+	}
+	if len(req.Locale) == 0 {
+		req.Locale = defaultLocale
+	}
+
+	email, err := renderEmail(req.Name, req.Locale, data)
+	if err != nil {
+		ctx.WriteString(err.Error())
+		return
+	}
+	ctx.JSON(iris.StatusOK, email)
+}
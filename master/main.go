@@ -32,6 +32,22 @@ type SlaveConfig struct {
 	Token   string `json:"token"`
 	PortMax int    `json:"portMax"`
 	PortMin int    `json:"portMin"`
+	// ServerName pins the identity in the slave's certificate, Host is used if it's empty.
+	ServerName string `json:"serverName,omitempty"`
+	// Endpoints are the IPs or DNS names advertised to users, Host is used if it's empty.
+	Endpoints []string `json:"endpoints,omitempty"`
+	// BindAddresses are the IPs on the slave to bind ports to, all IPv4 addresses if it's empty.
+	// Add both "0.0.0.0" and "::" to serve on dual stack.
+	BindAddresses []string `json:"bindAddresses,omitempty"`
+	IPv6First     bool     `json:"ipv6First,omitempty"`
+}
+
+// AdvertisedEndpoints returns the addresses users connect to.
+func (c *SlaveConfig) AdvertisedEndpoints() []string {
+	if len(c.Endpoints) != 0 {
+		return c.Endpoints
+	}
+	return []string{c.Host}
 }
 
 type GroupConfig struct {
@@ -41,23 +57,44 @@ type GroupConfig struct {
 	Limit    struct {
 		Flow int64 `json:"flow"` // MB
 		Time int64 `json:"time"` // hours
+		// Period is when the flow quota is reset, "day", "week" or "month". The quota is for
+		// the lifetime of users if it's empty.
+		Period string `json:"period,omitempty"`
+		// ResetDay is the day of the week (0 for Sunday) or of the month (1 by default, the
+		// last day for shorter months) a period begins.
+		ResetDay int `json:"resetDay,omitempty"`
+		// Timezone is the IANA name of the timezone periods begin in, UTC by default.
+		Timezone string `json:"timezone,omitempty"`
 	} `json:"limit"`
+	// Method is the encrypt method of the ports of the group, aes-256-cfb by default.
+	Method string `json:"method,omitempty"`
+	// ACLs are the names of ACLs enforced on the ports of the group.
+	ACLs []string `json:"acls,omitempty"`
 }
 
 type Config struct {
 	Host     string         `json:"host"`
 	Port     int            `json:"port"`
-	Password string         `json:"password"`
+	Password string         `json:"password,omitempty"` // moved into the admins table on start
 	Interval int            `json:"interval"`
 	Slaves   []*SlaveConfig `json:"slaves"`
-	Groups   []*GroupConfig `json:"groups"`
-	Email    struct {
+	// Groups are moved into database on the first start, and managed by admins since then.
+	Groups []*GroupConfig `json:"groups,omitempty"`
+	Email  struct {
 		Host      string `json:"host"`
 		Port      int    `json:"port"`
 		Username  string `json:"username"`
 		Password  string `json:"password"`
 		FromAddr  string `json:"fromAddr"`
-		FromAlias string `json:"fromAddr"`
+		FromAlias string `json:"fromAlias"`
+		// Transport is one of "smtp" (default), "sendmail" and "maildir".
+		Transport    string `json:"transport,omitempty"`
+		SendmailPath string `json:"sendmailPath,omitempty"`
+		// Maildir is where the "maildir" transport delivers mails.
+		Maildir string `json:"maildir,omitempty"`
+		// TemplateDir overrides the built-in templates of emails, with a sub directory for each
+		// locale, e.g. "en/verify.html".
+		TemplateDir string `json:"templateDir,omitempty"`
 	} `json:"email"`
 	Database struct {
 		Dialect   string `json:"dialect"`
@@ -69,6 +106,32 @@ type Config struct {
 		Channel string   `json:"channel"`
 		Levels  []string `json:"levels"`
 	} `json:"slack,omitempty"`
+	TLS *struct {
+		CAFile   string `json:"caFile"`
+		CertFile string `json:"certFile"`
+		KeyFile  string `json:"keyFile"`
+	} `json:"tls,omitempty"`
+	// AllowInsecure must be set explicitly to talk to slaves without TLS.
+	AllowInsecure bool `json:"allowInsecure,omitempty"`
+	// CADir is the directory of the built-in CA, defaults to "ca" next to the config file.
+	CADir string `json:"caDir,omitempty"`
+	// Metrics are served to admins on /metrics, or on a separate address if it's given.
+	Metrics *struct {
+		Address string `json:"address,omitempty"`
+	} `json:"metrics,omitempty"`
+	// ACLs are the named ACLs assigned to groups, in addition to the built-in ones.
+	ACLs []*ACLConfig `json:"acls,omitempty"`
+	// Budgets limit the traffic of all slaves or of a slave in a period, with actions taken
+	// when they run out.
+	Budgets []*BudgetConfig `json:"budgets,omitempty"`
+	// Notify sets when users are warned of their quota and expiry, defaults are used if it's
+	// not set.
+	Notify *struct {
+		// QuotaWarnings are the ratios of quota used, e.g. 0.8 for 80%.
+		QuotaWarnings []float64 `json:"quotaWarnings"`
+		// ExpiryWarnings are the hours before expiry.
+		ExpiryWarnings []int64 `json:"expiryWarnings"`
+	} `json:"notify,omitempty"`
 }
 
 var db *gorm.DB
@@ -111,6 +174,13 @@ func main() {
 		logrus.Fatal(err)
 	}
 
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Args()); err != nil {
+			logrus.Fatal(err)
+		}
+		return
+	}
+
 	// enable slack hook if slack is configured
 
 	if config.Slack != nil {
@@ -142,18 +212,46 @@ func main() {
 
 	InitSlaves()
 	InitGroups()
+	InitBudgets()
+	InitMetrics()
+	InitMail()
+	InitAdmins()
 
 	// If servers config is changed, clear removed and allocate new
 	CleanInvalidAllocation()
 	AllocateAllUsers()
 
 	go Monitoring()
+	go MailQueue()
 
 	webServer := NewApp(*webroot)
 	listenAddr := fmt.Sprintf("%s:%d", config.Host, config.Port)
 	webServer.Listen(listenAddr)
 }
 
+// runCommand runs the subcommand given after the flags.
+func runCommand(args []string) error {
+	switch args[0] {
+	case "enroll":
+		return runEnroll(args[1:])
+	case "admin":
+		return runAdmin(args[1:])
+	case "openapi":
+		return json.NewEncoder(os.Stdout).Encode(openAPISpec())
+	default:
+		return fmt.Errorf("unknown command %s", args[0])
+	}
+}
+
+// saveConfig writes the config back into the file it's parsed from.
+func saveConfig() error {
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(*configPath, data, 0644)
+}
+
 func parseConfig(path string) (*Config, error) {
 	file, err := os.Open(path)
 	if err != nil {
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/kataras/iris"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/arkbriar/ssmgr/master/orm"
+)
+
+const metricsNamespace = "ssmgr_master"
+
+var (
+	getStatsDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "slave",
+		Name:      "get_stats_duration_seconds",
+		Help:      "Latencies of GetStats calls to slaves in seconds.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"slave"})
+	getStatsFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "slave",
+		Name:      "get_stats_failures_total",
+		Help:      "Failed GetStats calls to slaves.",
+	}, []string{"slave"})
+	monitoringDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "monitoring_duration_seconds",
+		Help:      "Durations of monitoring loops in seconds.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 10),
+	})
+	verifyEmails = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "verify_emails_total",
+		Help:      "Verify emails delivered or given up, by result.",
+	}, []string{"result"})
+	budgetUsage = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "budget_usage_ratio",
+		Help:      "Ratio of the traffic budget used in the current period, the slave is empty for budgets of all slaves.",
+	}, []string{"slave", "period"})
+)
+
+var (
+	usersDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "users"),
+		"Number of users, by group and state.",
+		[]string{"group", "state"}, nil,
+	)
+	allocationsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "slave", "allocations"),
+		"Number of ports allocated on the slave.",
+		[]string{"slave"}, nil,
+	)
+	portPoolUsageDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "slave", "port_pool_usage_ratio"),
+		"Ratio of allocated ports in the slave's port pool.",
+		[]string{"slave"}, nil,
+	)
+	flowDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "flow_bytes"),
+		"Total flow of all users in bytes.",
+		nil, nil,
+	)
+	mailsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "mails"),
+		"Number of mails in the outbox, by status.",
+		[]string{"status"}, nil,
+	)
+)
+
+// dbCollector collects metrics from database when scraped.
+type dbCollector struct{}
+
+func (dbCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- usersDesc
+	ch <- allocationsDesc
+	ch <- portPoolUsageDesc
+	ch <- flowDesc
+	ch <- mailsDesc
+}
+
+func (dbCollector) Collect(ch chan<- prometheus.Metric) {
+	var users []struct {
+		Group    string
+		Disabled bool
+		Count    int64
+	}
+	err := db.Raw("SELECT `group`, disabled, count(*) AS count FROM users GROUP BY `group`, disabled").Scan(&users).Error
+	if err != nil {
+		logrus.Warnf("Failed to collect users: %s", err)
+	}
+	for _, u := range users {
+		state := "active"
+		if u.Disabled {
+			state = "disabled"
+		}
+		ch <- prometheus.MustNewConstMetric(usersDesc, prometheus.GaugeValue, float64(u.Count), u.Group, state)
+	}
+
+	var allocs []struct {
+		ServerID string
+		Count    int64
+	}
+	err = db.Table(orm.Allocation{}.TableName()).Select("server_id, count(*) AS count").Group("server_id").Scan(&allocs).Error
+	if err != nil {
+		logrus.Warnf("Failed to collect allocations: %s", err)
+	}
+	allocated := make(map[string]int64)
+	for _, a := range allocs {
+		allocated[a.ServerID] = a.Count
+	}
+	for id, slave := range slaves {
+		ch <- prometheus.MustNewConstMetric(allocationsDesc, prometheus.GaugeValue, float64(allocated[id]), id)
+
+		if size := slave.Config.PortMax - slave.Config.PortMin + 1; size > 0 {
+			ch <- prometheus.MustNewConstMetric(portPoolUsageDesc, prometheus.GaugeValue,
+				float64(allocated[id])/float64(size), id)
+		}
+	}
+
+	var flow struct{ Flow int64 }
+	db.Raw("SELECT sum(flow) AS flow FROM flow_record").Scan(&flow)
+	ch <- prometheus.MustNewConstMetric(flowDesc, prometheus.GaugeValue, float64(flow.Flow))
+
+	var mails []struct {
+		Status string
+		Count  int64
+	}
+	if err := db.Raw("SELECT status, count(*) AS count FROM mail_outbox GROUP BY status").Scan(&mails).Error; err != nil {
+		logrus.Warnf("Failed to collect mails: %s", err)
+	}
+	for _, m := range mails {
+		ch <- prometheus.MustNewConstMetric(mailsDesc, prometheus.GaugeValue, float64(m.Count), m.Status)
+	}
+}
+
+var metricsHandler http.Handler
+
+// InitMetrics registers the metrics of master, and serves them on a separate address if it's
+// configured.
+func InitMetrics() {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(dbCollector{}, getStatsDuration, getStatsFailures, monitoringDuration, verifyEmails, budgetUsage)
+	metricsHandler = promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+
+	if config.Metrics != nil && len(config.Metrics.Address) != 0 {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", metricsHandler)
+
+			logrus.Infof("Serving metrics on %s", config.Metrics.Address)
+
+			if err := http.ListenAndServe(config.Metrics.Address, mux); err != nil {
+				logrus.Errorf("Metrics server stopped: %s", err)
+			}
+		}()
+	}
+}
+
+// handleMetrics serves metrics to admins, when metrics are not bound to a separate address.
+func handleMetrics(ctx *iris.Context) {
+	if config.Metrics != nil && len(config.Metrics.Address) != 0 {
+		ctx.SetStatusCode(iris.StatusNotFound)
+		ctx.WriteString("not found")
+		return
+	}
+	if !requirePermission(ctx, permSettingsRead) {
+		return
+	}
+	metricsHandler.ServeHTTP(ctx.ResponseWriter, ctx.Request)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/arkbriar/ssmgr/master/orm"
+)
+
+// Kinds of notices sent to users.
+const (
+	noticeQuota    = "quota"
+	noticeExpiry   = "expiry"
+	noticeDisabled = "disabled"
+)
+
+// Default thresholds of warnings, when notify is not configured.
+var (
+	defaultQuotaWarnings  = []float64{0.8, 0.95}
+	defaultExpiryWarnings = []int64{72, 24}
+)
+
+func quotaWarnings() []float64 {
+	if config.Notify == nil {
+		return defaultQuotaWarnings
+	}
+	return config.Notify.QuotaWarnings
+}
+
+func expiryWarnings() []int64 {
+	if config.Notify == nil {
+		return defaultExpiryWarnings
+	}
+	return config.Notify.ExpiryWarnings
+}
+
+// sendNotice queues a notice to the user once in the period, which is the expiry of the user so
+// that a renewed user is notified again, or the beginning of the quota period for quota notices
+// of groups with one. The notice is recorded before it's queued, and the
+// record is removed if it can't be queued, to be tried in the next monitoring loop. Failed
+// deliveries are retried by the outbox.
+func sendNotice(userID, email, locale, kind string, threshold, period int64, name string, data map[string]interface{}) {
+	const where = "user_id = ? AND kind = ? AND threshold = ? AND period = ?"
+
+	var count int
+	db.Model(&orm.Notice{}).Where(where, userID, kind, threshold, period).Count(&count)
+	if count > 0 {
+		return
+	}
+
+	notice := orm.Notice{
+		UserID:    userID,
+		Kind:      kind,
+		Threshold: threshold,
+		Period:    period,
+		Time:      time.Now().Unix(),
+	}
+	if err := db.Create(&notice).Error; err != nil {
+		logrus.Errorf("Failed to record notice for %s: %s", userID, err.Error())
+		return
+	}
+
+	data["Email"] = email
+	if err := queueEmail(email, name, locale, data, 0); err != nil {
+		logrus.Errorf("Failed to queue %s notice to %s: %s", kind, email, err.Error())
+		db.Where(where, userID, kind, threshold, period).Delete(&orm.Notice{})
+	}
+}
+
+// checkUserNotices warns the enabled users approaching their quota or expiry.
+func checkUserNotices() error {
+	flowSQL, args := quotaFlowSQL(time.Now())
+	SQL := `SELECT users.id, email, locale, ` + "`group`" + `, quota_flow, ` + flowSQL + ` AS current_flow, expired
+FROM users LEFT JOIN flow_record ON users.id = flow_record.user_id
+WHERE disabled = 0
+GROUP BY users.id, email, locale, ` + "`group`" + `, quota_flow, expired`
+
+	rows, err := db.Raw(SQL, args...).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type userUsage struct {
+		ID          string
+		Email       string
+		Locale      string
+		Group       string
+		QuotaFlow   int64
+		CurrentFlow int64
+		Expired     int64
+	}
+	var users []userUsage
+	for rows.Next() {
+		var u userUsage
+		rows.Scan(&u.ID, &u.Email, &u.Locale, &u.Group, &u.QuotaFlow, &u.CurrentFlow, &u.Expired)
+		users = append(users, u)
+	}
+
+	now := time.Now().Unix()
+	for _, u := range users {
+		if u.QuotaFlow > 0 && u.CurrentFlow < u.QuotaFlow {
+			// only the highest threshold reached is sent
+			var reached float64
+			for _, ratio := range quotaWarnings() {
+				if float64(u.CurrentFlow) >= ratio*float64(u.QuotaFlow) && ratio > reached {
+					reached = ratio
+				}
+			}
+			if reached > 0 {
+				percent := int64(reached * 100)
+				sendNotice(u.ID, u.Email, u.Locale, noticeQuota, percent, quotaNoticePeriod(u.Group, u.Expired), emailQuotaWarning,
+					map[string]interface{}{
+						"Percent": percent,
+						"Used":    formatFlow(u.CurrentFlow),
+						"Quota":   formatFlow(u.QuotaFlow),
+					})
+			}
+		}
+
+		if left := u.Expired - now; left > 0 {
+			// only the nearest threshold is sent
+			var reached int64
+			for _, hours := range expiryWarnings() {
+				if left <= hours*3600 && (reached == 0 || hours < reached) {
+					reached = hours
+				}
+			}
+			if reached > 0 {
+				expired := time.Unix(u.Expired, 0).Format("2006-01-02 15:04")
+				sendNotice(u.ID, u.Email, u.Locale, noticeExpiry, reached, u.Expired, emailExpiryWarning,
+					map[string]interface{}{"ExpireTime": expired})
+			}
+		}
+	}
+	return nil
+}
+
+// sendDisabledNotice tells the user why the account is disabled, the reason is "quota" or
+// "expired".
+func sendDisabledNotice(userID, reason string) {
+	var user orm.User
+	db.Where("id = ?", userID).First(&user)
+	if user.ID == "" {
+		return
+	}
+	period := user.Expired
+	if reason == "quota" {
+		period = quotaNoticePeriod(user.Group, user.Expired)
+	}
+	sendNotice(user.ID, user.Email, user.Locale, noticeDisabled, 0, period, emailDisabled,
+		map[string]interface{}{"Reason": reason})
+}
+
+// quotaNoticePeriod returns the period of quota notices of a user in the group, which is the
+// beginning of the quota period, or the expiry of the user if the quota is for its lifetime.
+func quotaNoticePeriod(groupID string, expired int64) int64 {
+	if group := getGroup(groupID); group != nil {
+		if start, _ := group.quotaPeriod(time.Now()); start != 0 {
+			return start
+		}
+	}
+	return expired
+}
+
+// formatFlow formats bytes in the largest unit.
+func formatFlow(bytes int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value, i := float64(bytes), 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.2f %s", value, units[i])
+}
@@ -15,7 +15,7 @@ func New(dialect, arg string) *gorm.DB {
 	}
 
 	// create tables, missing columns and missing indexes
-	db.AutoMigrate(&User{}, &Allocation{}, &FlowRecord{}, &VerifyCode{})
+	db.AutoMigrate(&User{}, &Allocation{}, &FlowRecord{}, &VerifyCode{}, &ExportTemplate{}, &Notice{}, &OutboxMail{}, &Admin{}, &APIToken{}, &UsageSnapshot{}, &Group{})
 
 	return db
 }
@@ -31,6 +31,25 @@ type User struct {
 	QuotaFlow int64 `gorm:"not null"`
 	Expired   int64 `gorm:"not null"`
 	Disabled  bool  `gorm:"not null"`
+	// DisabledReason is why the user is disabled, "quota" or "expired", empty if it's disabled
+	// by admins. Users disabled for quota are enabled again when a new quota period begins.
+	DisabledReason string
+	DisabledAt     int64
+
+	// SubscriptionToken authenticates the subscription URL of the user, it's revoked by
+	// replacing it with a new one.
+	SubscriptionToken string `gorm:"index"`
+
+	// Locale is the language of emails sent to the user, chosen by the browser at signup.
+	Locale string
+
+	// PasswordHash is the bcrypt hash of the password, empty if the user logs in with verify
+	// codes only.
+	PasswordHash string
+	// FailedLogins counts the wrong passwords in a row, the user is locked until LockedUntil
+	// when there are too many.
+	FailedLogins int   `gorm:"not null"`
+	LockedUntil  int64 `gorm:"not null"`
 }
 
 func (User) TableName() string {
@@ -62,6 +81,140 @@ func (VerifyCode) TableName() string {
 	return "verify_code"
 }
 
+// Group is a group of users sharing slaves and limits. Groups are moved from config.json into
+// this table on the first start.
+type Group struct {
+	ID   string `gorm:"primary_key"`
+	Name string `gorm:"not null"`
+	// Slaves are the IDs of slaves separated by commas.
+	Slaves string `gorm:"type:text"`
+	Flow   int64  `gorm:"not null"` // MB
+	Time   int64  `gorm:"not null"` // hours
+	// Period, ResetDay and Timezone are the quota period, the quota is for the lifetime of
+	// users if Period is empty.
+	Period   string
+	ResetDay int
+	Timezone string
+	// Method is the encrypt method of allocations, the default one if it's empty.
+	Method string
+	// ACLs are the names of ACLs separated by commas.
+	ACLs string `gorm:"column:acls;type:text"`
+}
+
+func (Group) TableName() string {
+	return "user_group"
+}
+
+// UsageSnapshot is the flow of a user on a server in an hour or a day, for charts of usage over
+// time.
+type UsageSnapshot struct {
+	ID       uint   `gorm:"primary_key"`
+	UserID   string `gorm:"unique_index:idx_usage_snapshot;size:32;not null"`
+	ServerID string `gorm:"unique_index:idx_usage_snapshot;not null"`
+	// Period is "hour" or "day".
+	Period string `gorm:"unique_index:idx_usage_snapshot;not null"`
+	// Start is the beginning of the hour or the day (UTC) in unix seconds.
+	Start int64 `gorm:"unique_index:idx_usage_snapshot;not null"`
+	Flow  int64 `gorm:"not null"`
+}
+
+func (UsageSnapshot) TableName() string {
+	return "usage_snapshot"
+}
+
+// Notice records a notice sent to a user, so that it's sent only once in a period.
+type Notice struct {
+	UserID string `gorm:"index,size:32"`
+	// Kind is one of "quota", "expiry" and "disabled".
+	Kind string `gorm:"not null"`
+	// Threshold is the percent of quota used, or the hours before expiry.
+	Threshold int64 `gorm:"not null"`
+	// Period is the expiry of the user when the notice is sent, or the beginning of the quota
+	// period for quota notices of groups with one.
+	Period int64 `gorm:"not null"`
+	Time   int64 `gorm:"not null"`
+}
+
+func (Notice) TableName() string {
+	return "notice"
+}
+
+// Admin is an account managing master, what it can do depends on its role.
+type Admin struct {
+	Username     string `gorm:"primary_key"`
+	PasswordHash string `gorm:"not null"`
+	// Role is one of "owner", "operator" and "support".
+	Role         string `gorm:"not null"`
+	Created      int64  `gorm:"not null"`
+	FailedLogins int    `gorm:"not null"`
+	LockedUntil  int64  `gorm:"not null"`
+}
+
+func (Admin) TableName() string {
+	return "admins"
+}
+
+// APIToken authenticates calls of the API on behalf of an admin, only its hash is stored.
+type APIToken struct {
+	ID    uint   `gorm:"primary_key"`
+	Name  string `gorm:"not null"`
+	Admin string `gorm:"index;not null"`
+	// Scopes are separated by commas.
+	Scopes string `gorm:"not null"`
+	// Hash is the hex encoded SHA-256 of the token.
+	Hash string `gorm:"unique_index;not null"`
+	// Prefix is the beginning of the token, to tell tokens apart.
+	Prefix   string
+	Created  int64 `gorm:"not null"`
+	LastUsed int64
+	// Expires is when the token expires, 0 for never.
+	Expires int64
+	// Revoked is when the token is revoked, 0 if it's not.
+	Revoked int64
+}
+
+func (APIToken) TableName() string {
+	return "api_token"
+}
+
+// OutboxMail is a mail waiting to be delivered, or delivered already for admins to check.
+type OutboxMail struct {
+	ID        uint   `gorm:"primary_key"`
+	Recipient string `gorm:"not null"`
+	// Name is the name of the template the mail is rendered from.
+	Name    string
+	Subject string
+	// Text and HTML are the rendered bodies, the message is built from them when it's sent, so
+	// that the Date header is the time of the delivery. HTML is empty for text only mails.
+	Text string `gorm:"type:text"`
+	HTML string `gorm:"column:html;type:text"`
+	// MessageID is kept across retries, so that clients can tell a mail delivered twice.
+	MessageID string
+	// Status is one of "queued", "sent", "failed" and "expired".
+	Status      string `gorm:"index;not null"`
+	Attempts    int    `gorm:"not null"`
+	NextAttempt int64  `gorm:"not null"`
+	LastError   string `gorm:"type:text"`
+	// Expires is when the mail is given up if it's not sent yet, 0 for never.
+	Expires int64
+	Created int64 `gorm:"not null"`
+	Sent    int64
+}
+
+func (OutboxMail) TableName() string {
+	return "mail_outbox"
+}
+
+// ExportTemplate replaces the default template of an export format.
+type ExportTemplate struct {
+	Format   string `gorm:"primary_key"`
+	Template string `gorm:"type:text;not null"`
+}
+
+func (ExportTemplate) TableName() string {
+	return "export_template"
+}
+
 // Below tables are for deamon
 
 type Allocation struct {
@@ -69,6 +222,10 @@ type Allocation struct {
 	ServerID string `gorm:"priamry_key"`
 	Port     int    `gorm:"not null,index"`
 	Password string `gorm:"not null"`
+	// A suspended port is kept on the slave but not served.
+	Suspended bool `gorm:"not null"`
+	// SuspendedUntil is when a suspended port is resumed automatically, 0 means never.
+	SuspendedUntil int64 `gorm:"not null"`
 }
 
 func (Allocation) TableName() string {
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+
+	"github.com/kataras/iris"
+	"github.com/skip2/go-qrcode"
+)
+
+const qrCodeSize = 256
+
+// qrCodeSVG renders the modules of a QR code as an SVG image, one unit for each module.
+func qrCodeSVG(bitmap [][]bool) []byte {
+	n := len(bitmap)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		qrCodeSize, qrCodeSize, n, n)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, n, n)
+	for y, row := range bitmap {
+		for x, black := range row {
+			if black {
+				fmt.Fprintf(&buf, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+	return buf.Bytes()
+}
+
+// handleQRCode renders the SIP002 URI of an allocation of the user as a QR code, in PNG or in
+// SVG if format is "svg". The endpoint param selects an endpoint of the slave, from 0.
+func handleQRCode(ctx *iris.Context) {
+	userID, serverID := ctx.URLParam("address"), ctx.URLParam("server")
+
+	isLogin := len(userID) != 0 && ctx.Session().GetString("user_id") == userID
+	if !isLogin && !hasPermission(ctx, permUsersRead) {
+		ctx.SetStatusCode(iris.StatusForbidden)
+		ctx.WriteString("please login first")
+		return
+	}
+
+	var servers []*subscriptionServer
+	for _, s := range subscriptionServers(userID) {
+		if s.ServerID == serverID {
+			servers = append(servers, s)
+		}
+	}
+	endpoint, _ := strconv.Atoi(ctx.URLParam("endpoint"))
+	if endpoint < 0 || endpoint >= len(servers) {
+		ctx.SetStatusCode(iris.StatusNotFound)
+		ctx.WriteString("allocation not found")
+		return
+	}
+
+	qr, err := qrcode.New(servers[endpoint].sip002(), qrcode.Medium)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	// the image carries the password
+	ctx.SetHeader("Cache-Control", "no-store")
+
+	if ctx.URLParam("format") == "svg" {
+		ctx.SetContentType("image/svg+xml")
+		ctx.Write(qrCodeSVG(qr.Bitmap()))
+		return
+	}
+	png, err := qr.PNG(qrCodeSize)
+	if err != nil {
+		panic(err.Error())
+	}
+	ctx.SetContentType("image/png")
+	ctx.Write(png)
+}
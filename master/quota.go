@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/arkbriar/ssmgr/master/orm"
+)
+
+// Periods of quotas of groups and of budgets.
+const (
+	quotaDay   = "day"
+	quotaWeek  = "week"
+	quotaMonth = "month"
+)
+
+// calendarPeriod is a day, week or month beginning on a day in a timezone.
+type calendarPeriod struct {
+	// Period is quotaDay, quotaWeek or quotaMonth, or empty for no period.
+	Period string
+	// ResetDay is the day of the week (0 for Sunday) or of the month (1 by default) a period
+	// begins.
+	ResetDay int
+	location *time.Location
+}
+
+// newCalendarPeriod checks the period, and loads the timezone (UTC by default).
+func newCalendarPeriod(period string, resetDay int, timezone string) (*calendarPeriod, error) {
+	switch period {
+	case "", quotaDay:
+	case quotaWeek:
+		if resetDay < 0 || resetDay > 6 {
+			return nil, errors.New("resetDay of a week must be 0 (Sunday) to 6")
+		}
+	case quotaMonth:
+		if resetDay < 0 || resetDay > 31 {
+			return nil, errors.New("resetDay of a month must be 1 to 31")
+		}
+	default:
+		return nil, fmt.Errorf("unknown period '%s', it must be day, week or month", period)
+	}
+
+	p := &calendarPeriod{Period: period, ResetDay: resetDay, location: time.UTC}
+	if len(timezone) != 0 {
+		loc, err := time.LoadLocation(timezone)
+		if err != nil {
+			return nil, err
+		}
+		p.location = loc
+	}
+	return p, nil
+}
+
+// dayOfMonth returns the beginning of the day in the month, or of the last day if the month is
+// shorter.
+func dayOfMonth(year int, month time.Month, day int, loc *time.Location) time.Time {
+	if last := time.Date(year, month+1, 0, 0, 0, 0, 0, loc).Day(); day > last {
+		day = last
+	}
+	return time.Date(year, month, day, 0, 0, 0, 0, loc)
+}
+
+// bounds returns the beginning and the end of the period at now, both are 0 if there's no period.
+func (p *calendarPeriod) bounds(now time.Time) (int64, int64) {
+	t := now.In(p.location)
+	year, month, day := t.Date()
+
+	var start, end time.Time
+	switch p.Period {
+	case quotaDay:
+		start = time.Date(year, month, day, 0, 0, 0, 0, p.location)
+		end = start.AddDate(0, 0, 1)
+	case quotaWeek:
+		back := (int(t.Weekday()) - p.ResetDay + 7) % 7
+		start = time.Date(year, month, day-back, 0, 0, 0, 0, p.location)
+		end = start.AddDate(0, 0, 7)
+	case quotaMonth:
+		resetDay := p.ResetDay
+		if resetDay == 0 {
+			resetDay = 1
+		}
+		start = dayOfMonth(year, month, resetDay, p.location)
+		if t.Before(start) {
+			month--
+			start = dayOfMonth(year, month, resetDay, p.location)
+		}
+		end = dayOfMonth(year, month+1, resetDay, p.location)
+	default:
+		return 0, 0
+	}
+	return start.Unix(), end.Unix()
+}
+
+// quotaPeriod returns the beginning and the end of the quota period of the group at now, both
+// are 0 if the quota is for the lifetime of users.
+func (g *Group) quotaPeriod(now time.Time) (int64, int64) {
+	return g.quota.bounds(now)
+}
+
+// periodFlowSQL sums the flow of users.id since a time from the hourly snapshots, the time is
+// the only arg.
+const periodFlowSQL = `COALESCE((SELECT SUM(usage_snapshot.flow) FROM usage_snapshot
+WHERE usage_snapshot.user_id = users.id AND usage_snapshot.period = 'hour' AND usage_snapshot.start >= ?), 0)`
+
+// quotaFlowSQL returns the SQL of the flow counted against the quota of users, in the current
+// periods of their groups, or since they're created. It's used in queries of users LEFT JOIN
+// flow_record grouped by user.
+func quotaFlowSQL(now time.Time) (string, []interface{}) {
+	var (
+		cases string
+		args  []interface{}
+	)
+	for _, group := range allGroups() {
+		if start, _ := group.quotaPeriod(now); start != 0 {
+			cases += " WHEN `group` = ? THEN " + periodFlowSQL
+			args = append(args, group.Config.ID, start)
+		}
+	}
+	if len(cases) == 0 {
+		return "COALESCE(SUM(flow_record.flow), 0)", nil
+	}
+	return "CASE" + cases + " ELSE COALESCE(SUM(flow_record.flow), 0) END", args
+}
+
+// quotaFlowOf returns the flow counted against the quota of the user.
+func quotaFlowOf(user *orm.User, now time.Time) int64 {
+	var flowSum []struct{ Flow int64 }
+	start := int64(0)
+	if group := getGroup(user.Group); group != nil {
+		start, _ = group.quotaPeriod(now)
+	}
+	if start != 0 {
+		db.Raw("SELECT sum(flow) AS flow FROM usage_snapshot WHERE user_id = ? AND period = ? AND start >= ?",
+			user.ID, usageHour, start).Scan(&flowSum)
+	} else {
+		db.Raw("SELECT sum(flow) AS flow FROM flow_record WHERE user_id = ?", user.ID).Scan(&flowSum)
+	}
+	if len(flowSum) == 0 {
+		return 0
+	}
+	return flowSum[0].Flow
+}
+
+// quotaPeriodOf returns the current quota period of the user, both are 0 if there isn't one.
+func quotaPeriodOf(user *orm.User, now time.Time) (int64, int64) {
+	if group := getGroup(user.Group); group != nil {
+		return group.quotaPeriod(now)
+	}
+	return 0, 0
+}
+
+// quotaPeriodStarts is the beginning of the quota period of groups seen by resetQuotaPeriods.
+var quotaPeriodStarts = make(map[string]int64)
+
+// resetQuotaPeriods enables the users disabled for quota in a previous period of their groups,
+// if they're not expired. Enabled users are allocated again once a period begins, slaves would
+// stop their ports with the quota of the previous period otherwise.
+func resetQuotaPeriods() {
+	now := time.Now()
+	for _, group := range allGroups() {
+		id := group.Config.ID
+		start, _ := group.quotaPeriod(now)
+		if start == 0 {
+			delete(quotaPeriodStarts, id)
+			continue
+		}
+
+		// master may be down when a period begins, so the first period seen is new as well
+		if quotaPeriodStarts[id] != start {
+			quotaPeriodStarts[id] = start
+
+			var enabled []orm.User
+			db.Where("`group` = ? AND disabled = 0", id).Find(&enabled)
+			logrus.Infof("New quota period of group %s begins, allocate for %d users", id, len(enabled))
+			go func(users []orm.User) {
+				for _, user := range users {
+					allocateForUser(user.ID, user.Group)
+				}
+			}(enabled)
+		}
+
+		var users []orm.User
+		db.Where("`group` = ? AND disabled = 1 AND disabled_reason = ? AND disabled_at < ? AND expired > ?",
+			id, "quota", start, now.Unix()).Find(&users)
+		for _, user := range users {
+			logrus.Infof("New quota period of user %s begins", user.ID)
+			EnableUser(user.ID)
+		}
+	}
+}
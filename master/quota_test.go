@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDayOfMonth(t *testing.T) {
+	cases := []struct {
+		year  int
+		month time.Month
+		day   int
+		want  string
+	}{
+		{2017, time.January, 31, "2017-01-31"},
+		{2017, time.February, 28, "2017-02-28"},
+		{2017, time.February, 31, "2017-02-28"},
+		{2016, time.February, 31, "2016-02-29"},
+		{2017, time.April, 31, "2017-04-30"},
+		{2017, time.April, 1, "2017-04-01"},
+		// months out of range are normalized, as the month before January
+		{2017, 0, 31, "2016-12-31"},
+		{2017, -1, 31, "2016-11-30"},
+		{2017, 13, 31, "2018-01-31"},
+		{2017, 14, 30, "2018-02-28"},
+	}
+	for _, c := range cases {
+		got := dayOfMonth(c.year, c.month, c.day, time.UTC)
+		if got.Format("2006-01-02") != c.want || got.Hour() != 0 || got.Minute() != 0 {
+			t.Errorf("dayOfMonth(%d, %d, %d) = %s, want %s", c.year, c.month, c.day, got, c.want)
+		}
+	}
+}
+
+func TestCalendarPeriodBounds(t *testing.T) {
+	shanghai := time.FixedZone("CST", 8*3600)
+	at := func(value string) time.Time {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+
+	cases := []struct {
+		period   string
+		resetDay int
+		location *time.Location
+		now      string
+		start    string
+		end      string
+	}{
+		{"", 0, time.UTC, "2017-03-15T12:00:00Z", "", ""},
+
+		{quotaDay, 0, time.UTC, "2017-03-15T12:00:00Z", "2017-03-15T00:00:00Z", "2017-03-16T00:00:00Z"},
+		{quotaDay, 0, time.UTC, "2017-12-31T23:59:59Z", "2017-12-31T00:00:00Z", "2018-01-01T00:00:00Z"},
+		{quotaDay, 0, shanghai, "2017-03-15T20:00:00Z", "2017-03-16T00:00:00+08:00", "2017-03-17T00:00:00+08:00"},
+
+		// 2017-01-01 is a Sunday
+		{quotaWeek, 0, time.UTC, "2017-01-01T00:00:00Z", "2017-01-01T00:00:00Z", "2017-01-08T00:00:00Z"},
+		{quotaWeek, 1, time.UTC, "2017-01-01T12:00:00Z", "2016-12-26T00:00:00Z", "2017-01-02T00:00:00Z"},
+		{quotaWeek, 1, time.UTC, "2017-01-02T00:00:00Z", "2017-01-02T00:00:00Z", "2017-01-09T00:00:00Z"},
+		{quotaWeek, 6, time.UTC, "2017-03-03T12:00:00Z", "2017-02-25T00:00:00Z", "2017-03-04T00:00:00Z"},
+
+		{quotaMonth, 0, time.UTC, "2017-03-15T12:00:00Z", "2017-03-01T00:00:00Z", "2017-04-01T00:00:00Z"},
+		{quotaMonth, 1, time.UTC, "2017-12-31T23:59:59Z", "2017-12-01T00:00:00Z", "2018-01-01T00:00:00Z"},
+		{quotaMonth, 15, time.UTC, "2017-03-15T00:00:00Z", "2017-03-15T00:00:00Z", "2017-04-15T00:00:00Z"},
+		{quotaMonth, 15, time.UTC, "2017-03-14T23:59:59Z", "2017-02-15T00:00:00Z", "2017-03-15T00:00:00Z"},
+		// before the reset day in January, the period begins in December of the year before
+		{quotaMonth, 15, time.UTC, "2017-01-10T00:00:00Z", "2016-12-15T00:00:00Z", "2017-01-15T00:00:00Z"},
+		{quotaMonth, 31, time.UTC, "2017-01-30T00:00:00Z", "2016-12-31T00:00:00Z", "2017-01-31T00:00:00Z"},
+		// the last day is the reset day of shorter months
+		{quotaMonth, 31, time.UTC, "2017-01-31T00:00:00Z", "2017-01-31T00:00:00Z", "2017-02-28T00:00:00Z"},
+		{quotaMonth, 31, time.UTC, "2017-03-15T00:00:00Z", "2017-02-28T00:00:00Z", "2017-03-31T00:00:00Z"},
+		{quotaMonth, 31, time.UTC, "2017-03-31T00:00:00Z", "2017-03-31T00:00:00Z", "2017-04-30T00:00:00Z"},
+		{quotaMonth, 30, time.UTC, "2016-02-29T12:00:00Z", "2016-02-29T00:00:00Z", "2016-03-30T00:00:00Z"},
+		{quotaMonth, 30, time.UTC, "2016-02-28T12:00:00Z", "2016-01-30T00:00:00Z", "2016-02-29T00:00:00Z"},
+		// periods begin in the timezone
+		{quotaMonth, 1, shanghai, "2017-01-31T20:00:00Z", "2017-02-01T00:00:00+08:00", "2017-03-01T00:00:00+08:00"},
+		{quotaMonth, 1, shanghai, "2017-01-31T15:00:00Z", "2017-01-01T00:00:00+08:00", "2017-02-01T00:00:00+08:00"},
+	}
+	for _, c := range cases {
+		p := &calendarPeriod{Period: c.period, ResetDay: c.resetDay, location: c.location}
+		start, end := p.bounds(at(c.now))
+
+		var wantStart, wantEnd int64
+		if c.start != "" {
+			wantStart, wantEnd = at(c.start).Unix(), at(c.end).Unix()
+		}
+		if start != wantStart || end != wantEnd {
+			t.Errorf("%s period from %d in %s at %s: bounds = %s, %s, want %s, %s",
+				c.period, c.resetDay, c.location, c.now,
+				time.Unix(start, 0).In(c.location), time.Unix(end, 0).In(c.location), c.start, c.end)
+		}
+	}
+}
@@ -8,16 +8,19 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/golang/protobuf/ptypes/empty"
 	"golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
 	"github.com/arkbriar/ssmgr/master/orm"
 	rpc "github.com/arkbriar/ssmgr/protocol"
 )
 
 var (
-	caFile = flag.String("ca", "", "Path of CA X.509(.pem) file (enable TLS when specified)")
+	caFile = flag.String("ca", "", "Path of CA X.509(.pem) file, overrides tls.caFile in config")
 )
 
 type Slave struct {
@@ -32,21 +35,28 @@ var slaves map[string]*Slave
 func InitSlaves() {
 	slaves = make(map[string]*Slave)
 
+	var creds *slaveTLS
+	if config.TLS != nil || len(*caFile) != 0 {
+		var err error
+		creds, err = loadSlaveTLS()
+		if err != nil {
+			logrus.Fatalf("Failed to load TLS credentials: %s", err)
+		}
+		logrus.Info("Encrypting grpc channel with mutual TLS")
+	} else if !config.AllowInsecure {
+		logrus.Fatal("TLS is not configured, set allowInsecure to talk to slaves without it")
+	} else {
+		logrus.Warn("Talking to slaves without TLS")
+	}
+
 	for _, info := range config.Slaves {
 		address := fmt.Sprintf("%s:%d", info.Host, info.Port)
 		md := metadata.Pairs("token", info.Token)
-		ctx := metadata.NewContext(context.Background(), md)
+		ctx := metadata.NewOutgoingContext(context.Background(), md)
 
 		opts := []grpc.DialOption{}
-		if len(*caFile) != 0 {
-			creds, err := credentials.NewClientTLSFromFile(*caFile, "")
-			if err != nil {
-				logrus.Warnf("Faild to construct a TLS from the input certificate: %s", *caFile)
-				opts = append(opts, grpc.WithInsecure())
-			} else {
-				opts = append(opts, grpc.WithTransportCredentials(creds))
-				logrus.Info("Encrypting grpc channel with TLS")
-			}
+		if creds != nil {
+			opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(creds.configFor(info))))
 		} else {
 			opts = append(opts, grpc.WithInsecure())
 		}
@@ -65,6 +75,101 @@ func InitSlaves() {
 	}
 }
 
+// describeError formats the status and details of an error returned by slave.
+func describeError(err error) string {
+	st, ok := status.FromError(err)
+	if !ok {
+		return err.Error()
+	}
+	desc := fmt.Sprintf("%s: %s", st.Code(), st.Message())
+	for _, detail := range st.Details() {
+		switch d := detail.(type) {
+		case *errdetails.BadRequest:
+			for _, v := range d.FieldViolations {
+				desc += fmt.Sprintf(", invalid %s (%s)", v.Field, v.Description)
+			}
+		case *errdetails.PreconditionFailure:
+			for _, v := range d.Violations {
+				desc += fmt.Sprintf(", %s", v.Description)
+			}
+		}
+	}
+	return desc
+}
+
+// allocate allocates a port on the slave. Allocation in database is the truth, so a port held
+// with different settings is freed and allocated again.
+func (s *Slave) allocate(req *rpc.AllocateRequest) error {
+	port := int(req.Port)
+	req.BindAddresses, req.Ipv6First = s.Config.BindAddresses, s.Config.IPv6First
+	_, err := s.stub.Allocate(s.ctx, req)
+	switch status.Code(err) {
+	case codes.OK:
+		return nil
+	case codes.AlreadyExists:
+		logrus.Warnf("Port %d on %s conflicts with allocation, %s. Reallocate it",
+			port, s.Config.ID, describeError(err))
+
+		if err := s.free(port); err != nil {
+			return err
+		}
+		if _, err := s.stub.Allocate(s.ctx, req); err != nil {
+			return fmt.Errorf("failed to reallocate port %d: %s", port, describeError(err))
+		}
+		return nil
+	default:
+		return fmt.Errorf("failed to allocate port %d: %s", port, describeError(err))
+	}
+}
+
+// free frees a port on the slave, it succeeds if the port is not allocated.
+func (s *Slave) free(port int) error {
+	_, err := s.stub.Free(s.ctx, &rpc.FreeRequest{
+		Port: int32(port),
+	})
+	switch status.Code(err) {
+	case codes.OK, codes.NotFound:
+		return nil
+	default:
+		return fmt.Errorf("failed to free port %d: %s", port, describeError(err))
+	}
+}
+
+// suspend stops serving a port on the slave, but keeps it allocated.
+func (s *Slave) suspend(port int) error {
+	_, err := s.stub.Suspend(s.ctx, &rpc.SuspendRequest{
+		Port: int32(port),
+		Mode: rpc.SuspendMode_REJECT,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to suspend port %d: %s", port, describeError(err))
+	}
+	return nil
+}
+
+// resume serves a suspended port on the slave again.
+func (s *Slave) resume(port int) error {
+	_, err := s.stub.Resume(s.ctx, &rpc.ResumeRequest{
+		Port: int32(port),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to resume port %d: %s", port, describeError(err))
+	}
+	return nil
+}
+
+// setACL sets the acl of a port on the slave, the port stays allocated.
+func (s *Slave) setACL(port int, rules []string) error {
+	_, err := s.stub.SetACL(s.ctx, &rpc.SetACLRequest{
+		Port:  int32(port),
+		Rules: rules,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set acl of port %d: %s", port, describeError(err))
+	}
+	return nil
+}
+
 func CleanInvalidAllocation() {
 	serverIDs := make([]string, 0)
 	for serverID, _ := range slaves {
@@ -76,6 +181,7 @@ func CleanInvalidAllocation() {
 
 func Monitoring() {
 	for {
+		start := time.Now()
 		for id, slave := range slaves {
 			if err := updateStats(id, slave); err != nil {
 				logrus.Error("Update status error: ", err.Error())
@@ -84,6 +190,14 @@ func Monitoring() {
 		if err := checkUserLimit(); err != nil {
 			logrus.Error("Check user limit error: ", err.Error())
 		}
+		if err := checkUserNotices(); err != nil {
+			logrus.Error("Check user notices error: ", err.Error())
+		}
+		ResumeExpiredSuspensions()
+		resetQuotaPeriods()
+		checkBudgets()
+		pruneUsageSnapshots(time.Now())
+		monitoringDuration.Observe(time.Since(start).Seconds())
 		time.Sleep(time.Duration(config.Interval) * time.Second)
 	}
 }
@@ -91,8 +205,10 @@ func Monitoring() {
 func updateStats(serverID string, slave *Slave) error {
 
 	type portInfo struct {
-		Password string
-		UserID   string
+		Password  string
+		UserID    string
+		Suspended bool
+		ACLRules  []string
 	}
 	portMap := make(map[int]portInfo)
 
@@ -101,16 +217,33 @@ func updateStats(serverID string, slave *Slave) error {
 
 	var allocs []orm.Allocation
 	db.Where("server_id = ?", serverID).Find(&allocs)
+
+	userIDs := make([]string, 0, len(allocs))
+	for _, alloc := range allocs {
+		userIDs = append(userIDs, alloc.UserID)
+	}
+	var users []orm.User
+	db.Where("id IN (?)", userIDs).Find(&users)
+	userGroups := make(map[string]string)
+	for _, user := range users {
+		userGroups[user.ID] = user.Group
+	}
+
 	for _, alloc := range allocs {
 		expected = append(expected, alloc.Port)
 		portMap[alloc.Port] = portInfo{
-			Password: alloc.Password,
-			UserID:   alloc.UserID,
+			Password:  alloc.Password,
+			UserID:    alloc.UserID,
+			Suspended: alloc.Suspended,
+			ACLRules:  aclRulesOf(userGroups[alloc.UserID]),
 		}
 	}
 
+	start := time.Now()
 	stats, err := slave.stub.GetStats(slave.ctx, &empty.Empty{})
+	getStatsDuration.WithLabelValues(serverID).Observe(time.Since(start).Seconds())
 	if err != nil {
+		getStatsFailures.WithLabelValues(serverID).Inc()
 		return err
 	}
 	for port, _ := range stats.Flow {
@@ -123,31 +256,52 @@ func updateStats(serverID string, slave *Slave) error {
 	shouldAlloc, shouldFree := diffPorts(expected, actual)
 
 	for _, port := range shouldAlloc {
-		_, err = slave.stub.Allocate(slave.ctx, &rpc.AllocateRequest{
-			Port:     int32(port),
-			Password: portMap[port].Password,
-			Method:   "aes-256-cfb", // const
-		})
-		if err != nil {
-			logrus.Errorf("Failed to allocate port: %s", err.Error())
+		req := allocationRequest(portMap[port].UserID, serverID, port, portMap[port].Password)
+		if err := slave.allocate(req); err != nil {
+			logrus.Error(err)
+			continue
+		}
+		if portMap[port].Suspended {
+			if err := slave.suspend(port); err != nil {
+				logrus.Error(err)
+			}
 		}
 	}
 
 	for _, port := range shouldFree {
-		_, err = slave.stub.Free(slave.ctx, &rpc.FreeRequest{
-			Port: int32(port),
-		})
-		if err != nil {
-			logrus.Errorf("Failed to allocate port: %s", err.Error())
+		if err := slave.free(port); err != nil {
+			logrus.Error(err)
 		}
 	}
 
 	// Update flow records according to statistics
 
+	now := time.Now()
+
 	for port, stat := range stats.Flow {
 		if _, ok := portMap[int(port)]; !ok {
 			continue // skip shouldFree
 		}
+		// keep suspension on slave same with allocation
+		suspended := stat.State == rpc.ServerState_SUSPENDED
+		if portMap[int(port)].Suspended && !suspended {
+			if err := slave.suspend(int(port)); err != nil {
+				logrus.Error(err)
+			}
+		} else if !portMap[int(port)].Suspended && suspended {
+			if err := slave.resume(int(port)); err != nil {
+				logrus.Error(err)
+			}
+		} else if stat.State != rpc.ServerState_RUNNING && !suspended {
+			logrus.Infof("Port %d of user %s on %s is stopped by slave: %s",
+				port, portMap[int(port)].UserID, serverID, stat.State)
+		}
+		// roll out changes of acl without freeing the port
+		if rules := portMap[int(port)].ACLRules; stat.AclDigest != rpc.ACLDigest(rules) {
+			if err := slave.setACL(int(port), rules); err != nil {
+				logrus.Error(err)
+			}
+		}
 		var record orm.FlowRecord
 		db.Where(&orm.FlowRecord{
 			UserID:    portMap[int(port)].UserID,
@@ -155,6 +309,11 @@ func updateStats(serverID string, slave *Slave) error {
 			StartTime: stat.StartTime,
 		}).FirstOrCreate(&record)
 
+		// the record is cumulative since the port started, snapshots keep the flow in between
+		if delta := stat.Traffic - record.Flow; delta > 0 {
+			recordUsage(portMap[int(port)].UserID, serverID, delta, now)
+		}
+
 		// db.Save(&record) not works as expected due to gorm's bug
 
 		db.Model(&orm.FlowRecord{}).Where(&orm.FlowRecord{
@@ -168,18 +327,20 @@ func updateStats(serverID string, slave *Slave) error {
 }
 
 func checkUserLimit() error {
-	const SQL = `SELECT user_id, quota_flow, sum(flow) AS current_flow, expired
-FROM users JOIN flow_record ON users.id = flow_record.user_id
+	now := time.Now()
+	flowSQL, args := quotaFlowSQL(now)
+	SQL := `SELECT users.id, quota_flow, ` + flowSQL + ` AS current_flow, expired
+FROM users LEFT JOIN flow_record ON users.id = flow_record.user_id
 WHERE disabled = 0
-GROUP BY user_id`
+GROUP BY users.id, ` + "`group`" + `, quota_flow, expired`
 
-	rows, err := db.Raw(SQL).Rows()
+	rows, err := db.Raw(SQL, args...).Rows()
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
 
-	shouldDisable := make([]string, 0)
+	shouldDisable := make(map[string][]string)
 	for rows.Next() {
 		var (
 			userID      string
@@ -189,14 +350,22 @@ GROUP BY user_id`
 		)
 		rows.Scan(&userID, &quotaFlow, &currentFlow, &expired)
 
-		if currentFlow >= quotaFlow || expired <= time.Now().Unix() {
+		if currentFlow >= quotaFlow || expired <= now.Unix() {
 			logrus.Infof("User expired or reached limit: %s", userID)
-			shouldDisable = append(shouldDisable, userID)
+
+			if currentFlow >= quotaFlow {
+				shouldDisable["quota"] = append(shouldDisable["quota"], userID)
+			} else {
+				shouldDisable["expired"] = append(shouldDisable["expired"], userID)
+			}
 		}
 	}
 
-	if len(shouldDisable) > 0 {
-		RemoveUser(shouldDisable...)
+	for reason, userIDs := range shouldDisable {
+		RemoveUser(reason, userIDs...)
+		for _, userID := range userIDs {
+			sendDisabledNotice(userID, reason)
+		}
 	}
 	return nil
 }
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/asaskevich/govalidator"
+	"github.com/kataras/iris"
+
+	"github.com/arkbriar/ssmgr/master/orm"
+)
+
+// subscriptionServer is a server in the subscription, one for each endpoint of an allocation.
+type subscriptionServer struct {
+	ID       string
+	ServerID string
+	Remarks  string
+	Host     string
+	Port     int
+	Password string
+	Method   string
+}
+
+// HostPort joins host and port, IPv6 addresses are enclosed in brackets.
+func (s *subscriptionServer) HostPort() string {
+	return net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+}
+
+// sip002 returns the SIP002 URI of the server.
+func (s *subscriptionServer) sip002() string {
+	userInfo := base64.RawURLEncoding.EncodeToString([]byte(s.Method + ":" + s.Password))
+	remarks := strings.Replace(url.QueryEscape(s.Remarks), "+", "%20", -1)
+	return "ss://" + userInfo + "@" + s.HostPort() + "/#" + remarks
+}
+
+// serverUUID derives a stable UUID for the server, so clients recognize it across updates.
+func serverUUID(parts ...string) string {
+	sum := sha1.Sum([]byte(strings.Join(parts, "/")))
+	sum[6] = (sum[6] & 0x0f) | 0x50 // version 5
+	sum[8] = (sum[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+func subscriptionServers(userID string) []*subscriptionServer {
+	var allocs []orm.Allocation
+	db.Where("user_id = ?", userID).Find(&allocs)
+	var user orm.User
+	db.Where("id = ?", userID).First(&user)
+	method := methodOfGroup(user.Group)
+
+	servers := make([]*subscriptionServer, 0, len(allocs))
+	for _, alloc := range allocs {
+		slave := slaves[alloc.ServerID]
+		if slave == nil {
+			logrus.Warnf("Server '%s' does not exist", alloc.ServerID)
+			continue
+		}
+
+		endpoints := slave.Config.AdvertisedEndpoints()
+		for _, endpoint := range endpoints {
+			remarks := slave.Config.Name
+			if len(endpoints) > 1 {
+				remarks = fmt.Sprintf("%s (%s)", slave.Config.Name, endpoint)
+			}
+			servers = append(servers, &subscriptionServer{
+				ID:       serverUUID(userID, alloc.ServerID, endpoint),
+				ServerID: alloc.ServerID,
+				Remarks:  remarks,
+				Host:     endpoint,
+				Port:     alloc.Port,
+				Password: alloc.Password,
+				Method:   method,
+			})
+		}
+	}
+	return servers
+}
+
+// handleSubscribe serves the subscription of the user owning the token in the format given by
+// "format" param, which is a base64 encoded list of SIP002 URIs by default.
+func handleSubscribe(ctx *iris.Context, token string) {
+	var user orm.User
+	if len(token) != 0 {
+		db.Where("subscription_token = ?", token).First(&user)
+	}
+	if user.ID == "" {
+		ctx.SetStatusCode(iris.StatusNotFound)
+		ctx.WriteString("subscription not found")
+		return
+	}
+	if user.Disabled {
+		ctx.SetStatusCode(iris.StatusForbidden)
+		ctx.WriteString("account is disabled")
+		return
+	}
+
+	format := ctx.URLParam("format")
+	if len(format) == 0 {
+		format = "sip002"
+	}
+	exporter, ok := exporters[format]
+	if !ok {
+		ctx.SetStatusCode(iris.StatusBadRequest)
+		ctx.WriteString("unknown format, supported: " + strings.Join(exportFormats(), ", "))
+		return
+	}
+
+	data := newExportData(&user)
+	if len(data.Servers) != 0 {
+		data.Server = data.Servers[0]
+		if i, err := strconv.Atoi(ctx.URLParam("server")); err == nil && i >= 0 && i < len(data.Servers) {
+			data.Server = data.Servers[i]
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := exporter.Export(&buf, data); err != nil {
+		logrus.Errorf("Failed to export %s for %s: %s", format, user.ID, err.Error())
+		ctx.SetStatusCode(iris.StatusInternalServerError)
+		ctx.WriteString("failed to export")
+		return
+	}
+	ctx.SetContentType(exporter.ContentType())
+	ctx.Write(buf.Bytes())
+}
+
+// handleSubscription returns the subscription token of the user, a token is created if the user
+// has none. The token is revoked and replaced by a new one when reset is true.
+func handleSubscription(ctx *iris.Context) {
+	var request struct {
+		UserID string `json:"address" valid:"length(32|32)"`
+		Reset  bool   `json:"reset"`
+	}
+	if err := ctx.ReadJSON(&request); err != nil {
+		panic(err.Error())
+	}
+	if _, err := govalidator.ValidateStruct(&request); err != nil {
+		ctx.WriteString(err.Error())
+		return
+	}
+
+	isLogin := ctx.Session().GetString("user_id") == request.UserID
+	if !isLogin && !hasPermission(ctx, permUsersRead) {
+		ctx.SetStatusCode(iris.StatusForbidden)
+		ctx.WriteString("please login first")
+		return
+	}
+
+	var user orm.User
+	db.Where("id = ?", request.UserID).First(&user)
+	if user.ID == "" {
+		ctx.SetStatusCode(iris.StatusNotFound)
+		ctx.WriteString("user not found")
+		return
+	}
+
+	token := user.SubscriptionToken
+	if len(token) == 0 || request.Reset {
+		if !isLogin && !hasPermission(ctx, permUsersWrite) {
+			ctx.SetStatusCode(iris.StatusForbidden)
+			ctx.WriteString("permission denied")
+			return
+		}
+		var err error
+		if token, err = randomToken(); err != nil {
+			panic(err.Error())
+		}
+		db.Table("users").Where("id = ?", user.ID).Update("subscription_token", token)
+	}
+
+	ctx.JSON(iris.StatusOK, map[string]string{
+		"token":  token,
+		"sip002": "/subscribe/" + token,
+		"sip008": "/subscribe/" + token + "?format=sip008",
+	})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+// slaveTLS holds the credentials shared by all grpc connections to slaves.
+type slaveTLS struct {
+	cert tls.Certificate
+	pool *x509.CertPool
+}
+
+// loadSlaveTLS loads the master's client certificate and the CA which signs the slaves'
+// certificates. The CA file given by -ca overrides the one in config.
+func loadSlaveTLS() (*slaveTLS, error) {
+	if config.TLS == nil {
+		return nil, errors.New("tls is not configured")
+	}
+
+	ca := config.TLS.CAFile
+	if len(*caFile) != 0 {
+		ca = *caFile
+	}
+	if len(ca) == 0 {
+		return nil, errors.New("tls.caFile is required")
+	}
+	if len(config.TLS.CertFile) == 0 || len(config.TLS.KeyFile) == 0 {
+		return nil, errors.New("tls.certFile and tls.keyFile are required to authenticate to slaves")
+	}
+
+	cert, err := tls.LoadX509KeyPair(config.TLS.CertFile, config.TLS.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	pem, err := ioutil.ReadFile(ca)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no valid certificate found in " + ca)
+	}
+
+	return &slaveTLS{cert: cert, pool: pool}, nil
+}
+
+// configFor returns a TLS config which only accepts the certificate of the given slave.
+func (t *slaveTLS) configFor(info *SlaveConfig) *tls.Config {
+	serverName := info.ServerName
+	if len(serverName) == 0 {
+		serverName = info.Host
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{t.cert},
+		RootCAs:      t.pool,
+		ServerName:   serverName,
+		MinVersion:   tls.VersionTLS12,
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/jinzhu/gorm"
+	"github.com/kataras/iris"
+
+	"github.com/arkbriar/ssmgr/master/orm"
+)
+
+// Periods of usage snapshots.
+const (
+	usageHour = "hour"
+	usageDay  = "day"
+)
+
+var usagePeriods = map[string]time.Duration{
+	usageHour: time.Hour,
+	usageDay:  24 * time.Hour,
+}
+
+const (
+	// usageHourRetention is how long hourly snapshots are kept, daily ones are kept forever.
+	usageHourRetention = 35 * 24 * time.Hour
+	// maxUsagePoints limits the points of a series, 62 days of hours.
+	maxUsagePoints = 62 * 24
+)
+
+// usageRanges are the shortcuts of ranges ending now, with their default periods.
+var usageRanges = map[string]struct {
+	Duration time.Duration
+	Period   string
+}{
+	"24h": {24 * time.Hour, usageHour},
+	"7d":  {7 * 24 * time.Hour, usageHour},
+	"30d": {30 * 24 * time.Hour, usageDay},
+	"90d": {90 * 24 * time.Hour, usageDay},
+}
+
+// recordUsage adds the flow of the user on the server to the snapshots of the hour and the day.
+// Days begin at 00:00 UTC.
+func recordUsage(userID, serverID string, flow int64, now time.Time) {
+	for period, d := range usagePeriods {
+		start := now.Truncate(d).Unix()
+		updated := db.Table(orm.UsageSnapshot{}.TableName()).
+			Where("user_id = ? AND server_id = ? AND period = ? AND start = ?", userID, serverID, period, start).
+			Update("flow", gorm.Expr("flow + ?", flow))
+		if updated.Error == nil && updated.RowsAffected == 0 {
+			db.Create(&orm.UsageSnapshot{
+				UserID:   userID,
+				ServerID: serverID,
+				Period:   period,
+				Start:    start,
+				Flow:     flow,
+			})
+		}
+	}
+}
+
+// pruneUsageSnapshots deletes the hourly snapshots older than usageHourRetention.
+func pruneUsageSnapshots(now time.Time) {
+	db.Where("period = ? AND start < ?", usageHour, now.Add(-usageHourRetention).Unix()).Delete(&orm.UsageSnapshot{})
+}
+
+type usagePoint struct {
+	// Time is the beginning of the hour or the day.
+	Time int64 `json:"time"`
+	Flow int64 `json:"flow"`
+}
+
+type usageSeries struct {
+	ServerID string        `json:"serverId"`
+	Points   []*usagePoint `json:"points"`
+}
+
+// usageSeriesResult is the flow of a user in each hour or day of a range, on every server and in
+// total. Hours or days without flow are included as zeros.
+type usageSeriesResult struct {
+	Period  string         `json:"period"`
+	From    int64          `json:"from"`
+	To      int64          `json:"to"`
+	Total   []*usagePoint  `json:"total"`
+	Servers []*usageSeries `json:"servers"`
+}
+
+// resolveUsageRange returns the period and the range of a usage query. The range is either a key
+// of usageRanges, or from and to (now by default) in unix seconds. The period is chosen from the
+// length of the range if it's empty.
+func resolveUsageRange(rangeName, period string, from, to int64, now time.Time) (string, int64, int64, error) {
+	if len(rangeName) != 0 {
+		r, ok := usageRanges[rangeName]
+		if !ok {
+			return "", 0, 0, errors.New("range must be 24h, 7d, 30d or 90d")
+		}
+		from, to = now.Add(-r.Duration).Unix(), now.Unix()
+		if len(period) == 0 {
+			period = r.Period
+		}
+	} else {
+		if from == 0 {
+			return "", 0, 0, errors.New("range or from is required")
+		}
+		if to == 0 {
+			to = now.Unix()
+		}
+		if len(period) == 0 {
+			period = usageHour
+			if to-from > 2*24*3600 {
+				period = usageDay
+			}
+		}
+	}
+
+	d, ok := usagePeriods[period]
+	if !ok {
+		return "", 0, 0, errors.New("period must be hour or day")
+	}
+	from = time.Unix(from, 0).Truncate(d).Unix()
+	if from > to {
+		return "", 0, 0, errors.New("from must be before to")
+	}
+	if (to-from)/int64(d/time.Second)+1 > maxUsagePoints {
+		return "", 0, 0, errors.New("too many points, choose a shorter range or a longer period")
+	}
+	return period, from, to, nil
+}
+
+// queryUsageSeries returns the usage of the user in the range resolved by resolveUsageRange.
+func queryUsageSeries(userID, period string, from, to int64) (*usageSeriesResult, error) {
+	var snapshots []orm.UsageSnapshot
+	err := db.Where("user_id = ? AND period = ? AND start >= ? AND start <= ?", userID, period, from, to).
+		Find(&snapshots).Error
+	if err != nil {
+		return nil, err
+	}
+
+	flows := make(map[string]map[int64]int64)
+	totals := make(map[int64]int64)
+	for _, s := range snapshots {
+		if flows[s.ServerID] == nil {
+			flows[s.ServerID] = make(map[int64]int64)
+		}
+		flows[s.ServerID][s.Start] += s.Flow
+		totals[s.Start] += s.Flow
+	}
+
+	step := int64(usagePeriods[period] / time.Second)
+	points := func(flow map[int64]int64) []*usagePoint {
+		ps := make([]*usagePoint, 0, (to-from)/step+1)
+		for t := from; t <= to; t += step {
+			ps = append(ps, &usagePoint{Time: t, Flow: flow[t]})
+		}
+		return ps
+	}
+
+	serverIDs := make([]string, 0, len(flows))
+	for id := range flows {
+		serverIDs = append(serverIDs, id)
+	}
+	sort.Strings(serverIDs)
+
+	result := &usageSeriesResult{
+		Period:  period,
+		From:    from,
+		To:      to,
+		Total:   points(totals),
+		Servers: make([]*usageSeries, 0, len(serverIDs)),
+	}
+	for _, id := range serverIDs {
+		result.Servers = append(result.Servers, &usageSeries{ServerID: id, Points: points(flows[id])})
+	}
+	return result, nil
+}
+
+// handleAccountUsage returns the usage series of the user logged in, or of any user for admins.
+// Times are in milliseconds.
+func handleAccountUsage(ctx *iris.Context) {
+	var request struct {
+		UserID string `json:"address" valid:"length(32|32)"`
+		// Range is 24h, 7d, 30d or 90d, or empty for From and To.
+		Range  string `json:"range" valid:"-"`
+		Period string `json:"period" valid:"-"`
+		From   int64  `json:"from" valid:"-"`
+		To     int64  `json:"to" valid:"-"`
+	}
+	if err := ctx.ReadJSON(&request); err != nil {
+		panic(err.Error())
+	}
+	if _, err := govalidator.ValidateStruct(&request); err != nil {
+		ctx.WriteString(err.Error())
+		return
+	}
+
+	isLogin := ctx.Session().GetString("user_id") == request.UserID
+	if !isLogin && !hasPermission(ctx, permUsersRead) {
+		ctx.SetStatusCode(iris.StatusForbidden)
+		ctx.WriteString("please login first")
+		return
+	}
+
+	period, from, to, err := resolveUsageRange(request.Range, request.Period, request.From/1000, request.To/1000, time.Now())
+	if err != nil {
+		ctx.SetStatusCode(iris.StatusBadRequest)
+		ctx.WriteString(err.Error())
+		return
+	}
+	result, err := queryUsageSeries(request.UserID, period, from, to)
+	if err != nil {
+		panic(err)
+	}
+
+	// convert to milliseconds
+	result.From *= 1000
+	result.To *= 1000
+	for _, p := range result.Total {
+		p.Time *= 1000
+	}
+	for _, s := range result.Servers {
+		for _, p := range s.Points {
+			p.Time *= 1000
+		}
+	}
+	ctx.JSON(iris.StatusOK, result)
+}
+
+func apiUserUsageSeries(r *apiRequest) {
+	u := getAPIUser(r, r.param("id"))
+	if u == nil {
+		return
+	}
+
+	var from, to int64
+	for name, v := range map[string]*int64{"from": &from, "to": &to} {
+		if q := r.query(name); len(q) != 0 {
+			t, err := strconv.ParseInt(q, 10, 64)
+			if err != nil {
+				r.fail(http.StatusBadRequest, "invalid_query", name+" must be a unix time")
+				return
+			}
+			*v = t
+		}
+	}
+	period, from, to, err := resolveUsageRange(r.query("range"), r.query("period"), from, to, time.Now())
+	if err != nil {
+		r.fail(http.StatusBadRequest, "invalid_query", err.Error())
+		return
+	}
+	result, err := queryUsageSeries(u.ID, period, from, to)
+	if err != nil {
+		r.fail(http.StatusInternalServerError, "internal", err.Error())
+		return
+	}
+	r.respond(http.StatusOK, result)
+}
@@ -12,8 +12,13 @@ import (
 	rpc "github.com/arkbriar/ssmgr/protocol"
 )
 
-func CreateUser(email string) *orm.User {
+// shadowsocksMethod is the encrypt method of allocations of groups without one.
+const shadowsocksMethod = "aes-256-cfb"
+
+// CreateUser creates a user in the default group, emails are sent to the user in the locale.
+func CreateUser(email, locale string) *orm.User {
 	now := time.Now()
+	defaultGroup := getGroup("default")
 	userID := hex.EncodeToString(uuid.NewV4().Bytes())
 	user := orm.User{
 		ID:        userID,
@@ -23,6 +28,7 @@ func CreateUser(email string) *orm.User {
 		Expired:   now.Add(time.Duration(defaultGroup.Config.Limit.Time) * time.Hour).Unix(),
 		Disabled:  false,
 		Group:     "default",
+		Locale:    locale,
 	}
 	db.Save(&user)
 
@@ -36,16 +42,16 @@ func CreateUser(email string) *orm.User {
 
 func ChangeUserGroup(userID, groupID string) error {
 	var user orm.User
-	db.First(&user)
+	db.Where("id = ?", userID).First(&user)
 	if user.ID == "" {
 		return fmt.Errorf("User not found: %s", userID)
 	}
-	group := groups[groupID]
+	group := getGroup(groupID)
 	if group == nil {
 		return fmt.Errorf("Group not found: %s", groupID)
 	}
 	user.Group = groupID
-	user.Expired = time.Unix(user.Time, 0).Add(time.Duration(defaultGroup.Config.Limit.Time) * time.Hour).Unix()
+	user.Expired = time.Unix(user.Time, 0).Add(time.Duration(group.Config.Limit.Time) * time.Hour).Unix()
 	user.QuotaFlow = group.Config.Limit.Flow * 1024 * 1024
 	// Let the daemon routine check whether to remove user (set disable = 1)
 
@@ -58,14 +64,127 @@ func ChangeUserGroup(userID, groupID string) error {
 	return err
 }
 
-func RemoveUser(userIDs ...string) {
+// RemoveUser disables the users for the reason, "quota", "expired", or empty for admins.
+func RemoveUser(reason string, userIDs ...string) {
 	if len(userIDs) == 0 {
 		return
 	}
 
-	db.Table("users").Where("id IN (?)", userIDs).Updates(&orm.User{Disabled: true})
+	db.Table("users").Where("id IN (?)", userIDs).Updates(map[string]interface{}{
+		"disabled":        true,
+		"disabled_reason": reason,
+		"disabled_at":     time.Now().Unix(),
+	})
+
+	// ports are kept, so the user gets the same servers once enabled again
+	go SuspendUser(0, userIDs...)
+}
+
+// EnableUser enables the disabled user, and serves its ports again with the quota left.
+func EnableUser(userID string) {
+	var user orm.User
+	db.Where("id = ?", userID).First(&user)
+	if user.ID == "" {
+		return
+	}
+
+	db.Table("users").Where("id = ?", userID).Updates(map[string]interface{}{
+		"disabled":        false,
+		"disabled_reason": "",
+		"disabled_at":     0,
+	})
+
+	go func() {
+		ResumeUser(userID)
+		// allocating again updates the quota of the ports on slaves
+		allocateForUser(userID, user.Group)
+	}()
+}
+
+// SuspendUser stops serving all ports of the users until the given unix time, 0 means until
+// they're resumed.
+func SuspendUser(until int64, userIDs ...string) {
+	var allocs []orm.Allocation
+	db.Table(orm.Allocation{}.TableName()).Where("user_id IN (?)", userIDs).Scan(&allocs)
+
+	db.Table(orm.Allocation{}.TableName()).Where("user_id IN (?)", userIDs).Updates(map[string]interface{}{
+		"suspended":       true,
+		"suspended_until": until,
+	})
+
+	for _, alloc := range allocs {
+		slave := slaves[alloc.ServerID]
+		if slave == nil {
+			continue
+		}
+		if err := slave.suspend(alloc.Port); err != nil {
+			logrus.Errorf("Failed to suspend ports for %s: %s", alloc.UserID, err.Error())
+		}
+	}
+}
+
+// suspendAllocations stops serving the ports of the allocations until the given unix time.
+func suspendAllocations(until int64, allocs ...orm.Allocation) {
+	for _, alloc := range allocs {
+		db.Table(orm.Allocation{}.TableName()).Where("user_id = ? AND server_id = ?", alloc.UserID, alloc.ServerID).
+			Updates(map[string]interface{}{
+				"suspended":       true,
+				"suspended_until": until,
+			})
+
+		slave := slaves[alloc.ServerID]
+		if slave == nil {
+			continue
+		}
+		if err := slave.suspend(alloc.Port); err != nil {
+			logrus.Errorf("Failed to suspend port %d of %s: %s", alloc.Port, alloc.UserID, err.Error())
+		}
+	}
+}
+
+// ResumeUser serves the suspended ports of the users again.
+func ResumeUser(userIDs ...string) {
+	var allocs []orm.Allocation
+	db.Table(orm.Allocation{}.TableName()).Where("user_id IN (?) AND suspended = 1", userIDs).Scan(&allocs)
+
+	db.Table(orm.Allocation{}.TableName()).Where("user_id IN (?)", userIDs).Updates(map[string]interface{}{
+		"suspended":       false,
+		"suspended_until": 0,
+	})
+
+	for _, alloc := range allocs {
+		slave := slaves[alloc.ServerID]
+		if slave == nil {
+			continue
+		}
+		if err := slave.resume(alloc.Port); err != nil {
+			logrus.Errorf("Failed to resume ports for %s: %s", alloc.UserID, err.Error())
+		}
+	}
+}
+
+// ResumeExpiredSuspensions resumes the enabled users whose suspension is over.
+func ResumeExpiredSuspensions() {
+	const SQL = `SELECT DISTINCT user_id FROM allocation JOIN users ON users.id = allocation.user_id
+WHERE suspended = 1 AND suspended_until > 0 AND suspended_until <= ? AND disabled = 0`
+
+	rows, err := db.Raw(SQL, time.Now().Unix()).Rows()
+	if err != nil {
+		logrus.Errorf("Failed to query suspensions: %s", err.Error())
+		return
+	}
+	defer rows.Close()
 
-	go removeUserAllocation(userIDs...)
+	var userIDs []string
+	for rows.Next() {
+		var userID string
+		rows.Scan(&userID)
+		userIDs = append(userIDs, userID)
+	}
+	if len(userIDs) > 0 {
+		logrus.Infof("Suspension is over: %v", userIDs)
+		ResumeUser(userIDs...)
+	}
 }
 
 func removeUserAllocation(userIDs ...string) {
@@ -91,7 +210,12 @@ func AllocateAllUsers() {
 	db.Where("disabled = 0").Find(&users)
 
 	for _, user := range users {
-		for _, serverID := range groups[user.Group].Config.SlaveIDs {
+		group := getGroup(user.Group)
+		if group == nil {
+			logrus.Warnf("Group '%s' of user %s not found", user.Group, user.ID)
+			continue
+		}
+		for _, serverID := range group.Config.SlaveIDs {
 			port, password, err := findOrInitAllocation(user.ID, serverID)
 			if err != nil {
 				logrus.Error(err.Error())
@@ -104,7 +228,12 @@ func AllocateAllUsers() {
 }
 
 func allocateForUser(userID, groupID string) {
-	for _, serverID := range groups[groupID].Config.SlaveIDs {
+	group := getGroup(groupID)
+	if group == nil {
+		logrus.Errorf("Failed to allocate ports for %s: group '%s' not found", userID, groupID)
+		return
+	}
+	for _, serverID := range group.Config.SlaveIDs {
 		err := allocateServerToUser(userID, serverID)
 		if err != nil {
 			logrus.Errorf("Failed to allocate ports for %s: %s", userID, err.Error())
@@ -124,15 +253,39 @@ func allocateServerToUser(userID, serverID string) error {
 
 	logrus.Debugf("Allocate for user %s on server %s: Port %d, Password: %s",
 		userID, serverID, port, password)
-	_, err = slave.stub.Allocate(slave.ctx, &rpc.AllocateRequest{
+	return slave.allocate(allocationRequest(userID, serverID, port, password))
+}
+
+// allocationRequest builds the request to allocate a port for the user on the server. It carries
+// the user's remaining quota and expiry, so the slave keeps enforcing them while master is
+// unreachable. Every allocation of the user gets the whole remaining quota, master still checks
+// the sum.
+func allocationRequest(userID, serverID string, port int, password string) *rpc.AllocateRequest {
+	req := &rpc.AllocateRequest{
 		Port:     int32(port),
 		Password: password,
-		Method:   "aes-256-cfb", // const
-	})
-	if err != nil {
-		return fmt.Errorf("Failed to allocate port: %s", err.Error())
+		Method:   shadowsocksMethod,
+	}
+
+	var user orm.User
+	db.Where("id = ?", userID).First(&user)
+	if user.ID == "" {
+		return req
+	}
+
+	remaining := user.QuotaFlow - quotaFlowOf(&user, time.Now())
+	if remaining <= 0 {
+		// 0 means unlimited
+		remaining = 1
 	}
-	return nil
+	// slaves count the traffic since the port is first started, including previous periods
+	var record orm.FlowRecord
+	db.Where("user_id = ? AND server_id = ?", userID, serverID).Order("start_time DESC").First(&record)
+	req.MaxTraffic = record.Flow + remaining
+	req.ExpireTime = time.Unix(user.Expired, 0).UnixNano()
+	req.Method = methodOfGroup(user.Group)
+	req.AclRules = aclRulesOf(user.Group)
+	return req
 }
 
 func findOrInitAllocation(userID, serverID string) (int, string, error) {
@@ -184,11 +337,5 @@ func FreeAllocation(serverID string, port int) error {
 		return fmt.Errorf("Server '%s' not found", serverID)
 	}
 
-	_, err := slave.stub.Free(slave.ctx, &rpc.FreeRequest{
-		Port: int32(port),
-	})
-	if err != nil {
-		return err
-	}
-	return nil
+	return slave.free(port)
 }
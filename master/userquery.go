@@ -0,0 +1,208 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// States of users in userFilter.
+const (
+	userStateActive    = "active"
+	userStateSuspended = "suspended"
+	userStateDisabled  = "disabled"
+)
+
+// userSortColumns are the columns users can be sorted by, to the SQL sorting them.
+var userSortColumns = map[string]string{
+	"email":   "email",
+	"group":   "`group`",
+	"created": "time",
+	"expires": "expired",
+	"quota":   "quota_flow",
+	"used":    "used_flow",
+	"usage":   "usage_ratio",
+}
+
+const userSuspendedSQL = "EXISTS (SELECT 1 FROM allocation WHERE allocation.user_id = users.id AND allocation.suspended = 1)"
+
+// userFilter selects, sorts and paginates users. Zero values don't filter.
+type userFilter struct {
+	ID    string
+	Group string
+	// State is one of userStateActive, userStateSuspended and userStateDisabled.
+	State    string
+	Disabled *bool
+	// Email matches a part of the email.
+	Email string
+	// ExpiresBefore is in unix seconds.
+	ExpiresBefore int64
+	// UsageAbove is a percentage of the quota, users without quota never match.
+	UsageAbove float64
+	// Sort is a key of userSortColumns, users are sorted by created by default.
+	Sort string
+	// Order is "asc" or "desc", desc by default.
+	Order string
+	// Page is from 1, all users are returned if PerPage is 0.
+	Page    int
+	PerPage int
+}
+
+// clampPage returns the page and items per page with the defaults and limits applied.
+func clampPage(page, perPage int) (int, int) {
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 {
+		perPage = defaultPerPage
+	}
+	if perPage > maxPerPage {
+		perPage = maxPerPage
+	}
+	return page, perPage
+}
+
+// sql builds the query of the filter, which selects users grouped by user, with the flow in
+// their current quota periods.
+func (f *userFilter) sql() (string, []interface{}, error) {
+	var (
+		conds  []string
+		having []string
+		args   []interface{}
+	)
+	flowSQL, flowArgs := quotaFlowSQL(time.Now())
+	columns := "users.id, email, `group`, locale, time, expired, quota_flow, disabled, password_hash, " +
+		flowSQL + " AS used_flow, CASE WHEN quota_flow > 0 THEN " + flowSQL + " * 1.0 / quota_flow ELSE 0 END AS usage_ratio"
+	args = append(args, flowArgs...)
+	args = append(args, flowArgs...)
+
+	if len(f.ID) != 0 {
+		conds = append(conds, "users.id = ?")
+		args = append(args, f.ID)
+	}
+	if len(f.Group) != 0 {
+		conds = append(conds, "`group` = ?")
+		args = append(args, f.Group)
+	}
+	switch f.State {
+	case "":
+	case userStateActive:
+		conds = append(conds, "disabled = 0 AND NOT "+userSuspendedSQL)
+	case userStateSuspended:
+		conds = append(conds, "disabled = 0 AND "+userSuspendedSQL)
+	case userStateDisabled:
+		conds = append(conds, "disabled = 1")
+	default:
+		return "", nil, errors.New("state must be active, suspended or disabled")
+	}
+	if f.Disabled != nil {
+		conds = append(conds, "disabled = ?")
+		args = append(args, *f.Disabled)
+	}
+	if len(f.Email) != 0 {
+		conds = append(conds, "email LIKE ? ESCAPE '!'")
+		args = append(args, "%"+escapeLike(f.Email)+"%")
+	}
+	if f.ExpiresBefore != 0 {
+		conds = append(conds, "expired < ?")
+		args = append(args, f.ExpiresBefore)
+	}
+	if f.UsageAbove != 0 {
+		having = append(having, "quota_flow > 0 AND used_flow * 100 > ? * quota_flow")
+		args = append(args, f.UsageAbove)
+	}
+
+	query := "SELECT " + columns + `
+FROM users LEFT JOIN flow_record ON users.id = flow_record.user_id`
+	if len(conds) != 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	query += " GROUP BY users.id, email, `group`, locale, time, expired, quota_flow, disabled, password_hash"
+	if len(having) != 0 {
+		query += " HAVING " + strings.Join(having, " AND ")
+	}
+	return query, args, nil
+}
+
+// orderBy returns the ORDER BY clause of the filter.
+func (f *userFilter) orderBy() (string, error) {
+	sort := f.Sort
+	if len(sort) == 0 {
+		sort = "created"
+	}
+	column, ok := userSortColumns[sort]
+	if !ok {
+		keys := make([]string, 0, len(userSortColumns))
+		for k := range userSortColumns {
+			keys = append(keys, k)
+		}
+		return "", errors.New("sort must be one of " + strings.Join(sortedStrings(keys), ", "))
+	}
+	order := strings.ToUpper(f.Order)
+	if len(order) == 0 {
+		order = "DESC"
+	}
+	if order != "ASC" && order != "DESC" {
+		return "", errors.New("order must be asc or desc")
+	}
+	return " ORDER BY " + column + " " + order + ", users.id", nil
+}
+
+// escapeLike escapes the wildcards of LIKE in s with "!", since MySQL and SQLite don't agree on
+// escaping backslashes.
+func escapeLike(s string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(s)
+}
+
+// queryUsers returns a page of the users matching the filter, with their flow.
+func queryUsers(f *userFilter) ([]*apiUser, error) {
+	query, args, err := f.sql()
+	if err != nil {
+		return nil, err
+	}
+	orderBy, err := f.orderBy()
+	if err != nil {
+		return nil, err
+	}
+	query += orderBy
+	if f.PerPage > 0 {
+		page, perPage := clampPage(f.Page, f.PerPage)
+		query += " LIMIT " + strconv.Itoa(perPage) + " OFFSET " + strconv.Itoa((page-1)*perPage)
+	}
+
+	rows, err := db.Raw(query, args...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make([]*apiUser, 0)
+	for rows.Next() {
+		var (
+			u        apiUser
+			locale   sql.NullString
+			password sql.NullString
+			usage    float64
+		)
+		rows.Scan(&u.ID, &u.Email, &u.Group, &locale, &u.Created, &u.Expires, &u.QuotaFlow, &u.Disabled, &password, &u.UsedFlow, &usage)
+		u.Locale = locale.String
+		u.HasPassword = len(password.String) != 0
+		users = append(users, &u)
+	}
+	return users, nil
+}
+
+// countUsers returns the number of users matching the filter, ignoring the pagination.
+func countUsers(f *userFilter) (int64, error) {
+	query, args, err := f.sql()
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	if err := db.Raw("SELECT COUNT(*) FROM ("+query+") AS matched", args...).Row().Scan(&total); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
@@ -1,17 +1,13 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"math/rand"
-	"net/http"
 	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/asaskevich/govalidator"
-	"github.com/kataras/go-mailer"
 	"github.com/kataras/iris"
 
 	"github.com/arkbriar/ssmgr/master/orm"
@@ -19,24 +15,16 @@ import (
 
 const verifyCodeExpire = 300
 
-var mail mailer.Service
-
 func NewApp(webroot string) *iris.Framework {
 
-	mail = mailer.New(mailer.Config{
-		Host:      config.Email.Host,
-		Port:      config.Email.Port,
-		Username:  config.Email.Username,
-		Password:  config.Email.Password,
-		FromAddr:  config.Email.FromAddr,
-		FromAlias: config.Email.FromAlias,
-	})
-
 	app := iris.New()
 
 	app.Post("/email", handleEmail)
 	app.Post("/code", handleCode)
+	app.Post("/login", handleLogin)
+	app.Put("/account/password", handleAccountPassword)
 	app.Post("/account", handleAccount)
+	app.Post("/account/usage", handleAccountUsage)
 	app.Post("/config", handleConfig)
 	app.Post("/password", handlePassword)
 	app.Put("/config", handleConfigPut)
@@ -45,12 +33,39 @@ func NewApp(webroot string) *iris.Framework {
 	app.Post("/flow", handleFlow)
 	app.Post("/group", handleGroup)
 	app.Put("/user", handleUserPut)
+	app.Put("/user/suspend", handleUserSuspend)
+	app.Post("/subscription", handleSubscription)
+	app.Post("/export/template", handleExportTemplate)
+	app.Put("/export/template", handleExportTemplatePut)
+	app.Post("/acl", handleACL)
+	app.Put("/acl", handleACLPut)
+	app.Put("/group/acl", handleGroupACLPut)
+	app.Post("/email/template", handleEmailTemplate)
+	app.Post("/email/template/preview", handleEmailPreview)
+	app.Post("/mail", handleMail)
+	app.Put("/mail/retry", handleMailRetry)
+	app.Post("/admin", handleAdmin)
+	app.Put("/admin", handleAdminPut)
+
+	// GET APIs are dispatched by the catch-all below
+	app.Post(apiPrefix+"/*path", handleAPI)
+	app.Put(apiPrefix+"/*path", handleAPI)
+	app.Patch(apiPrefix+"/*path", handleAPI)
+	app.Delete(apiPrefix+"/*path", handleAPI)
 
 	app.Get("/*path", func(ctx *iris.Context) {
 		path := ctx.Param("path")
 		switch {
 		case strings.HasPrefix(path, "/libs"), strings.HasPrefix(path, "/public"):
 			ctx.ServeFile(webroot+path, true)
+		case strings.HasPrefix(path, apiPrefix+"/"):
+			handleAPI(ctx)
+		case strings.HasPrefix(path, "/subscribe/"):
+			handleSubscribe(ctx, strings.TrimPrefix(path, "/subscribe/"))
+		case path == "/qrcode":
+			handleQRCode(ctx)
+		case path == "/metrics":
+			handleMetrics(ctx)
 		default:
 			ctx.ServeFile(webroot+"/views/index.html", true)
 		}
@@ -59,14 +74,9 @@ func NewApp(webroot string) *iris.Framework {
 	return app
 }
 
-func isAdmin(ctx *iris.Context) bool {
-	admin, err := ctx.Session().GetBoolean("is_admin")
-	return err == nil && admin
-}
-
 func handleEmail(ctx *iris.Context) {
 	var request struct {
-		Email string `json:"email",valid:"email"`
+		Email string `json:"email" valid:"email,required"`
 	}
 	if err := ctx.ReadJSON(&request); err != nil {
 		panic(err.Error())
@@ -90,13 +100,27 @@ func handleEmail(ctx *iris.Context) {
 	vcode := fmt.Sprintf("%06d", rand.Int31n(1000000))
 	logrus.Infof("Send verify code to %s: %s", request.Email, vcode)
 
-	content := fmt.Sprintf("Your verify code is %s.\n", vcode)
-	go func() {
-		err := mail.Send("Free Shadowsocks", content, request.Email)
-		if err != nil {
-			logrus.Errorf("Failed to send email: %s", err)
-		}
-	}()
+	// Registered users get emails in their own locale
+	locale := matchLocale(ctx.RequestHeader("Accept-Language"))
+	var user orm.User
+	db.Where("email = ? AND disabled = 0", request.Email).First(&user)
+	if len(user.Locale) != 0 {
+		locale = user.Locale
+	}
+
+	data := map[string]interface{}{
+		"Email":         request.Email,
+		"Code":          vcode,
+		"ExpireMinutes": verifyCodeExpire / 60,
+	}
+	// The code is useless once it expires, so is the mail
+	expires := time.Now().Add(verifyCodeExpire * time.Second).Unix()
+	if err := queueEmail(request.Email, emailVerify, locale, data, expires); err != nil {
+		logrus.Errorf("Failed to queue verify email to %s: %s", request.Email, err)
+		ctx.SetStatusCode(iris.StatusInternalServerError)
+		ctx.WriteString("failed to send email")
+		return
+	}
 
 	db.Save(&orm.VerifyCode{
 		Email: request.Email,
@@ -109,8 +133,8 @@ func handleEmail(ctx *iris.Context) {
 
 func handleCode(ctx *iris.Context) {
 	var request struct {
-		Email string `json:"email",valid:"email"`
-		Code  string `json:"code",valid:"length(6|6)"`
+		Email string `json:"email" valid:"email"`
+		Code  string `json:"code" valid:"length(6|6)"`
 	}
 	if err := ctx.ReadJSON(&request); err != nil {
 		panic(err.Error())
@@ -121,10 +145,7 @@ func handleCode(ctx *iris.Context) {
 		return
 	}
 
-	var records []orm.VerifyCode
-	timeFrom := time.Now().Add(-verifyCodeExpire * time.Second).Unix()
-	db.Where("email = ? AND code = ? AND time > ?", request.Email, request.Code, timeFrom).Find(&records)
-	if len(records) == 0 {
+	if !checkVerifyCode(request.Email, request.Code) {
 		ctx.SetStatusCode(iris.StatusForbidden)
 		ctx.WriteString("login failed")
 		return
@@ -134,8 +155,16 @@ func handleCode(ctx *iris.Context) {
 	db.Where("email = ? AND disabled = 0", request.Email).First(&user)
 
 	if user.Email == "" {
+		if period, stopped := signupsStopped(); stopped {
+			ctx.SetStatusCode(iris.StatusForbidden)
+			ctx.WriteString("out of limit, global." + period)
+			return
+		}
 		// User is not created yet
-		user = *CreateUser(request.Email)
+		user = *CreateUser(request.Email, matchLocale(ctx.RequestHeader("Accept-Language")))
+	} else if user.LockedUntil != 0 || user.FailedLogins != 0 {
+		// Verifying the email proves the owner of the user
+		unlockLogin("users", "id", user.ID)
 	}
 
 	ctx.Session().Set("user_id", user.ID)
@@ -144,7 +173,7 @@ func handleCode(ctx *iris.Context) {
 
 func handleAccount(ctx *iris.Context) {
 	var request struct {
-		UserID string `json:"address",valid:"length(32|32)"`
+		UserID string `json:"address" valid:"length(32|32)"`
 	}
 	if err := ctx.ReadJSON(&request); err != nil {
 		panic(err.Error())
@@ -155,28 +184,29 @@ func handleAccount(ctx *iris.Context) {
 	}
 
 	isLogin := ctx.Session().GetString("user_id") == request.UserID
-	isAdmin, _ := ctx.Session().GetBoolean("is_admin")
-
-	if !isLogin && !isAdmin {
+	if !isLogin && !hasPermission(ctx, permUsersRead) {
 		ctx.SetStatusCode(iris.StatusForbidden)
 		ctx.WriteString("please login first")
 		return
 	}
 
 	var (
-		user    orm.User
-		allocs  []orm.Allocation
-		flowSum []struct{ Flow int64 }
+		user   orm.User
+		allocs []orm.Allocation
 	)
 	db.Where("id = ?", request.UserID).First(&user)
 	db.Where("user_id = ?", request.UserID).Find(&allocs)
-	db.Raw("SELECT sum(flow) AS flow FROM flow_record WHERE user_id = ?", request.UserID).Scan(&flowSum)
+	now := time.Now()
+	periodStart, periodEnd := quotaPeriodOf(&user, now)
 
 	type serverInfo struct {
-		Host     string `json:"host"`
-		Port     int    `json:"port"`
-		Password string `json:"password"`
-		Name     string `json:"name"`
+		ID        string   `json:"id"`
+		Host      string   `json:"host"`
+		Endpoints []string `json:"endpoints"`
+		Port      int      `json:"port"`
+		Password  string   `json:"password"`
+		Name      string   `json:"name"`
+		Suspended bool     `json:"isSuspended"`
 	}
 	servers := make([]*serverInfo, 0, len(allocs))
 
@@ -187,11 +217,15 @@ func handleAccount(ctx *iris.Context) {
 			continue
 		}
 
+		endpoints := slave.Config.AdvertisedEndpoints()
 		servers = append(servers, &serverInfo{
-			Host:     slave.Config.Host,
-			Port:     alloc.Port,
-			Password: alloc.Password,
-			Name:     slave.Config.Name,
+			ID:        alloc.ServerID,
+			Host:      endpoints[0],
+			Endpoints: endpoints,
+			Port:      alloc.Port,
+			Password:  alloc.Password,
+			Name:      slave.Config.Name,
+			Suspended: alloc.Suspended,
 		})
 	}
 
@@ -205,41 +239,27 @@ func handleAccount(ctx *iris.Context) {
 		Disabled    bool          `json:"isDisabled"`
 		Servers     []*serverInfo `json:"servers"`
 		Method      string        `json:"method"`
+		HasPassword bool          `json:"hasPassword"`
+		// The quota period currentFlow is counted in, 0 if the quota is for the lifetime.
+		PeriodStart int64 `json:"periodStart"`
+		PeriodEnd   int64 `json:"periodEnd"`
 	}
 	ctx.JSON(iris.StatusOK, &response{
 		Address:     request.UserID,
 		Email:       user.Email,
 		Flow:        user.QuotaFlow,
-		CurrentFlow: flowSum[0].Flow,
+		CurrentFlow: quotaFlowOf(&user, now),
 		Time:        user.Time * 1000, // convert to milliseconds
 		Expired:     user.Expired * 1000,
 		Disabled:    user.Disabled,
 		Servers:     servers,
-		Method:      "aes-256-cfb",
+		Method:      methodOfGroup(user.Group),
+		HasPassword: len(user.PasswordHash) != 0,
+		PeriodStart: periodStart * 1000,
+		PeriodEnd:   periodEnd * 1000,
 	})
 }
 
-func handlePassword(ctx *iris.Context) {
-	var request struct {
-		Password string `json:"password",valid:"-"`
-	}
-	if err := ctx.ReadJSON(&request); err != nil {
-		panic(err.Error())
-	}
-	if _, err := govalidator.ValidateStruct(&request); err != nil {
-		ctx.WriteString(err.Error())
-		return
-	}
-
-	if request.Password == config.Password {
-		ctx.Session().Set("is_admin", true)
-		ctx.WriteString("success")
-	} else {
-		ctx.SetStatusCode(http.StatusForbidden)
-		ctx.WriteString("login failed")
-	}
-}
-
 type systemConfig struct {
 	Shadowsocks struct {
 		Flow int64 `json:"flow"`
@@ -261,22 +281,19 @@ type systemConfig struct {
 
 // TODO: Currently front-end does not support config for groups
 func handleConfig(ctx *iris.Context) {
-	if !isAdmin(ctx) {
-		ctx.SetStatusCode(iris.StatusUnauthorized)
-		ctx.WriteString("please login first")
+	if !requirePermission(ctx, permSettingsRead) {
 		return
 	}
 
 	var ret systemConfig
+	defaultGroup := getGroup("default")
 	ret.Shadowsocks.Flow = defaultGroup.Config.Limit.Flow
 	ret.Shadowsocks.Time = defaultGroup.Config.Limit.Time
 	ctx.JSON(iris.StatusOK, &ret)
 }
 
 func handleConfigPut(ctx *iris.Context) {
-	if !isAdmin(ctx) {
-		ctx.SetStatusCode(iris.StatusUnauthorized)
-		ctx.WriteString("please login first")
+	if !requirePermission(ctx, permSettingsWrite) {
 		return
 	}
 
@@ -285,17 +302,14 @@ func handleConfigPut(ctx *iris.Context) {
 		panic(err.Error())
 	}
 
-	defaultGroup.Config.Limit.Flow = req.Shadowsocks.Flow
-	defaultGroup.Config.Limit.Time = req.Shadowsocks.Time
-
-	// Save into config file
-	go func() {
-		data, _ := json.MarshalIndent(config, "", "  ")
-		err := ioutil.WriteFile(*configPath, data, 0644)
-		if err != nil {
-			logrus.Warn("Failed to save config: %s", err.Error())
-		}
-	}()
+	c := *getGroup("default").Config
+	c.Limit.Flow = req.Shadowsocks.Flow
+	c.Limit.Time = req.Shadowsocks.Time
+	if err := saveGroup(&c); err != nil {
+		ctx.WriteString(err.Error())
+		return
+	}
+	ctx.WriteString("success")
 }
 
 func handleLogout(ctx *iris.Context) {
@@ -303,25 +317,56 @@ func handleLogout(ctx *iris.Context) {
 	ctx.WriteString("success")
 }
 
+// handleUser lists a page of users for the admin user table, users without flow included. Times
+// are in milliseconds.
 func handleUser(ctx *iris.Context) {
-	if !isAdmin(ctx) {
-		ctx.SetStatusCode(iris.StatusUnauthorized)
-		ctx.WriteString("please login first")
+	if !requirePermission(ctx, permUsersRead) {
 		return
 	}
 
-	const SQL = `SELECT user_id, email, quota_flow, sum(flow) AS current_flow, time, expired, disabled
-FROM users JOIN flow_record ON users.id = flow_record.user_id
-GROUP BY user_id`
-	rows, err := db.Raw(SQL).Rows()
+	var request struct {
+		Page    int    `json:"page"`
+		PerPage int    `json:"perPage"`
+		Group   string `json:"group"`
+		// State is active, suspended or disabled.
+		State         string  `json:"state"`
+		Email         string  `json:"email"`
+		ExpiresBefore int64   `json:"expiresBefore"`
+		UsageAbove    float64 `json:"usageAbove"`
+		Sort          string  `json:"sort"`
+		Order         string  `json:"order"`
+	}
+	if ctx.Request.ContentLength != 0 {
+		if err := ctx.ReadJSON(&request); err != nil {
+			panic(err.Error())
+		}
+	}
+
+	f := &userFilter{
+		Group:         request.Group,
+		State:         request.State,
+		Email:         request.Email,
+		ExpiresBefore: request.ExpiresBefore / 1000,
+		UsageAbove:    request.UsageAbove,
+		Sort:          request.Sort,
+		Order:         request.Order,
+	}
+	f.Page, f.PerPage = clampPage(request.Page, request.PerPage)
+	users, err := queryUsers(f)
+	if err != nil {
+		ctx.SetStatusCode(iris.StatusBadRequest)
+		ctx.WriteString(err.Error())
+		return
+	}
+	total, err := countUsers(f)
 	if err != nil {
 		panic(err)
 	}
-	defer rows.Close()
 
 	type response struct {
 		UserID      string `json:"address"`
 		Email       string `json:"email"`
+		Group       string `json:"group"`
 		Flow        int64  `json:"flow"`
 		CurrentFlow int64  `json:"currentFlow"`
 		Time        int64  `json:"time"`
@@ -329,26 +374,26 @@ GROUP BY user_id`
 		Disabled    bool   `json:"isDisabled"`
 	}
 
-	users := make([]*response, 0)
-
-	for rows.Next() {
-		var u response
-		rows.Scan(&u.UserID, &u.Email, &u.Flow, &u.CurrentFlow, &u.Time, &u.Expired, &u.Disabled)
-
-		// convert to milliseconds
-		u.Time *= 1000
-		u.Expired *= 1000
-
-		users = append(users, &u)
+	items := make([]*response, 0, len(users))
+	for _, u := range users {
+		items = append(items, &response{
+			UserID:      u.ID,
+			Email:       u.Email,
+			Group:       u.Group,
+			Flow:        u.QuotaFlow,
+			CurrentFlow: u.UsedFlow,
+			// convert to milliseconds
+			Time:     u.Created * 1000,
+			Expired:  u.Expires * 1000,
+			Disabled: u.Disabled,
+		})
 	}
 
-	ctx.JSON(iris.StatusOK, users)
+	ctx.JSON(iris.StatusOK, &apiPage{Items: items, Page: f.Page, PerPage: f.PerPage, Total: total})
 }
 
 func handleFlow(ctx *iris.Context) {
-	if !isAdmin(ctx) {
-		ctx.SetStatusCode(iris.StatusUnauthorized)
-		ctx.WriteString("please login first")
+	if !requirePermission(ctx, permUsersRead) {
 		return
 	}
 
@@ -363,9 +408,7 @@ func handleFlow(ctx *iris.Context) {
 }
 
 func handleGroup(ctx *iris.Context) {
-	if !isAdmin(ctx) {
-		ctx.SetStatusCode(iris.StatusUnauthorized)
-		ctx.WriteString("please login first")
+	if !requirePermission(ctx, permUsersRead) {
 		return
 	}
 
@@ -373,14 +416,12 @@ func handleGroup(ctx *iris.Context) {
 }
 
 type userConfig struct {
-	UserID  string `json:"user_id",valid:"length(32|32)"`
+	UserID  string `json:"user_id" valid:"length(32|32)"`
 	GroupID string `json:"group_id"`
 }
 
 func handleUserPut(ctx *iris.Context) {
-	if !isAdmin(ctx) {
-		ctx.SetStatusCode(iris.StatusUnauthorized)
-		ctx.WriteString("please login first")
+	if !requirePermission(ctx, permUsersWrite) {
 		return
 	}
 
@@ -403,3 +444,38 @@ func handleUserPut(ctx *iris.Context) {
 		return
 	}
 }
+
+type userSuspension struct {
+	UserID    string `json:"user_id" valid:"length(32|32),required"`
+	Suspended bool   `json:"suspended"`
+	// Minutes to suspend the user for, 0 means until resumed.
+	Minutes int64 `json:"minutes"`
+}
+
+func handleUserSuspend(ctx *iris.Context) {
+	if !requirePermission(ctx, permUsersWrite) {
+		return
+	}
+
+	var req userSuspension
+	if err := ctx.ReadJSON(&req); err != nil {
+		panic(err.Error())
+	}
+	if _, err := govalidator.ValidateStruct(&req); err != nil {
+		ctx.WriteString(err.Error())
+		return
+	}
+
+	if !req.Suspended {
+		go ResumeUser(req.UserID)
+		ctx.WriteString("success")
+		return
+	}
+
+	var until int64
+	if req.Minutes > 0 {
+		until = time.Now().Add(time.Duration(req.Minutes) * time.Minute).Unix()
+	}
+	go SuspendUser(until, req.UserID)
+	ctx.WriteString("success")
+}
@@ -0,0 +1,34 @@
+package protocol
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// ValidACLRule checks a rule of the outbound block list, which is an IP, a CIDR or a regex of
+// hostnames. It's checked by master when ACLs are changed, and by slaves before rules are
+// written into the acl file of ss-server.
+func ValidACLRule(rule string) error {
+	if len(strings.TrimSpace(rule)) == 0 {
+		return errors.New("rule is empty")
+	}
+	if strings.ContainsAny(rule, "\r\n") {
+		return errors.New("rule " + rule + " contains line breaks")
+	}
+	if strings.HasPrefix(rule, "[") || strings.HasPrefix(rule, "#") {
+		return errors.New("rule " + rule + " starts a section or comment")
+	}
+	return nil
+}
+
+// ACLDigest returns the digest of acl rules, which is reported by slaves so that master can tell
+// if the rules of a port are outdated. It's empty when there's no rules.
+func ACLDigest(rules []string) string {
+	if len(rules) == 0 {
+		return ""
+	}
+	sum := sha1.Sum([]byte(strings.Join(rules, "\n")))
+	return hex.EncodeToString(sum[:])
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 
@@ -15,6 +16,8 @@ import (
 	proto "github.com/arkbriar/ssmgr/protocol"
 	slave "github.com/arkbriar/ssmgr/slave"
 	ss "github.com/arkbriar/ssmgr/slave/shadowsocks"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 )
@@ -35,7 +38,16 @@ type slaveConfig struct {
 	TLS     *struct {
 		CertFile string `json:"cert_file"`
 		KeyFile  string `json:"key_file"`
+		CAFile   string `json:"ca_file"`
+		// MasterName pins the identity in the master's client certificate.
+		MasterName string `json:"master_name,omitempty"`
 	} `json:"tls,omitempty"`
+	// AllowInsecure must be set explicitly to serve without TLS.
+	AllowInsecure bool `json:"allow_insecure,omitempty"`
+	// MetricsAddress is the address to serve prometheus metrics, disabled if it's empty.
+	MetricsAddress string `json:"metrics_address,omitempty"`
+	// StateDir is the directory to store the state and files of managed servers.
+	StateDir string `json:"state_dir,omitempty"`
 }
 
 // Global configuration object
@@ -46,7 +58,7 @@ func parseConfig(filename string) (*slaveConfig, error) {
 	if err != nil {
 		return nil, err
 	}
-	c := &slaveConfig{Port: 8001, MgrPort: 6001}
+	c := &slaveConfig{Port: 8001, MgrPort: 6001, StateDir: ss.DefaultStateDir()}
 	if err := json.Unmarshal(d, c); err != nil {
 		return nil, err
 	}
@@ -57,6 +69,18 @@ func checkConfig(c *slaveConfig) error {
 	if len(c.Token) == 0 {
 		return errors.New("invalid token")
 	}
+	if c.TLS == nil {
+		if !c.AllowInsecure {
+			return errors.New("tls is not configured, set allow_insecure to serve without it")
+		}
+		return nil
+	}
+	if len(c.TLS.CertFile) == 0 || len(c.TLS.KeyFile) == 0 {
+		return errors.New("tls requires cert_file and key_file")
+	}
+	if len(c.TLS.CAFile) == 0 {
+		return errors.New("tls requires ca_file to verify the master")
+	}
 	return nil
 }
 
@@ -75,6 +99,17 @@ func init() {
 	}
 }
 
+func serveMetrics(addr string, reg *prometheus.Registry) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+
+	log.Infof("Serving metrics on %s", addr)
+
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Errorf("Metrics server stopped, %s", err)
+	}
+}
+
 func run(ctx context.Context) error {
 	select {
 	case <-ctx.Done():
@@ -82,29 +117,47 @@ func run(ctx context.Context) error {
 	default:
 	}
 
-	mgr := ss.NewManager(conf.MgrPort)
+	mgr := ss.NewManager(conf.StateDir, conf.MgrPort)
 	if err := mgr.Listen(context.Background()); err != nil {
 		return err
 	}
 
 	token := conf.Token
-	serverOpts := []grpc.ServerOption{
-		grpc.UnaryInterceptor(slave.UnaryAuthInterceptor(token)),
-		grpc.StreamInterceptor(slave.StreamAuthInterceptor(token)),
-	}
+	auth := &slave.Auth{Token: token}
 
-	// enable grpc channel with credentials
+	// enable grpc channel with mutual TLS
 
+	var serverOpts []grpc.ServerOption
 	if conf.TLS != nil {
-		log.Info("Encrypting grpc channel with TLS")
+		log.Info("Encrypting grpc channel with mutual TLS")
 
-		cred, err := credentials.NewServerTLSFromFile(conf.TLS.CertFile, conf.TLS.KeyFile)
+		tlsConfig, err := slave.NewServerTLSConfig(conf.TLS.CertFile, conf.TLS.KeyFile, conf.TLS.CAFile)
 		if err != nil {
 			return err
 		}
-		serverOpts = append(serverOpts, grpc.Creds(cred))
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		auth.PeerName = conf.TLS.MasterName
+	} else {
+		log.Warn("Serving grpc channel without TLS")
+	}
+	unaryInterceptors := []grpc.UnaryServerInterceptor{slave.UnaryAuthInterceptor(auth)}
+
+	// export metrics when metrics address is given
+
+	if len(conf.MetricsAddress) != 0 {
+		grpcMetrics := slave.NewGRPCMetrics()
+		unaryInterceptors = append([]grpc.UnaryServerInterceptor{grpcMetrics.UnaryInterceptor()}, unaryInterceptors...)
+
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(slave.NewManagerCollector(mgr), grpcMetrics)
+		go serveMetrics(conf.MetricsAddress, reg)
 	}
 
+	serverOpts = append(serverOpts,
+		grpc.UnaryInterceptor(slave.ChainUnaryInterceptors(unaryInterceptors...)),
+		grpc.StreamInterceptor(slave.StreamAuthInterceptor(auth)),
+	)
+
 	s := grpc.NewServer(serverOpts...)
 	proto.RegisterSSMgrSlaveServer(s, slave.NewSSMgrSlaveServer(token, mgr))
 
@@ -0,0 +1,151 @@
+package slave
+
+import (
+	"fmt"
+	"time"
+
+	ss "github.com/arkbriar/ssmgr/slave/shadowsocks"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const metricsNamespace = "ssmgr_slave"
+
+var (
+	portTrafficDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "port", "traffic_bytes"),
+		"Traffic transferred through the port in bytes.",
+		[]string{"port"}, nil,
+	)
+	portAliveDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "port", "alive"),
+		"Whether the ss-server of the port is alive.",
+		[]string{"port"}, nil,
+	)
+	portRestartsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "port", "restarts_total"),
+		"Times the ss-server of the port is restarted.",
+		[]string{"port"}, nil,
+	)
+	portConnLimitDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "port", "connection_limit"),
+		"Connection limit of the port, 0 means unlimited.",
+		[]string{"port"}, nil,
+	)
+	serversDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "servers"),
+		"Number of managed ss-servers.",
+		nil, nil,
+	)
+	statPacketsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "stat_packets_total"),
+		"Stat packets received from ss-servers, by result.",
+		[]string{"result"}, nil,
+	)
+)
+
+// managerCollector collects metrics of the servers managed by `Manager`.
+type managerCollector struct {
+	mgr ss.Manager
+}
+
+// NewManagerCollector returns a prometheus collector exporting metrics of the managed servers.
+func NewManagerCollector(mgr ss.Manager) prometheus.Collector {
+	return &managerCollector{mgr: mgr}
+}
+
+func (c *managerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- portTrafficDesc
+	ch <- portAliveDesc
+	ch <- portRestartsDesc
+	ch <- portConnLimitDesc
+	ch <- serversDesc
+	ch <- statPacketsDesc
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (c *managerCollector) Collect(ch chan<- prometheus.Metric) {
+	servers := c.mgr.ListServers()
+	for port, s := range servers {
+		p := fmt.Sprint(port)
+		ch <- prometheus.MustNewConstMetric(portTrafficDesc, prometheus.CounterValue, float64(s.GetStat().Traffic), p)
+		ch <- prometheus.MustNewConstMetric(portAliveDesc, prometheus.GaugeValue, boolToFloat(s.Alive()), p)
+		ch <- prometheus.MustNewConstMetric(portRestartsDesc, prometheus.CounterValue, float64(s.Restarts()), p)
+		ch <- prometheus.MustNewConstMetric(portConnLimitDesc, prometheus.GaugeValue, float64(s.ConnLimit()), p)
+	}
+	ch <- prometheus.MustNewConstMetric(serversDesc, prometheus.GaugeValue, float64(len(servers)))
+
+	stats := c.mgr.PacketStats()
+	ch <- prometheus.MustNewConstMetric(statPacketsDesc, prometheus.CounterValue, float64(stats.Received-stats.Dropped), "accepted")
+	ch <- prometheus.MustNewConstMetric(statPacketsDesc, prometheus.CounterValue, float64(stats.Dropped), "dropped")
+}
+
+// GRPCMetrics measures the latencies and errors of grpc calls.
+type GRPCMetrics struct {
+	duration *prometheus.HistogramVec
+	requests *prometheus.CounterVec
+}
+
+// NewGRPCMetrics creates a GRPCMetrics.
+func NewGRPCMetrics() *GRPCMetrics {
+	return &GRPCMetrics{
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "grpc",
+			Name:      "request_duration_seconds",
+			Help:      "Latencies of grpc calls in seconds.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method"}),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "grpc",
+			Name:      "requests_total",
+			Help:      "Grpc calls handled, by method and status code.",
+		}, []string{"method", "code"}),
+	}
+}
+
+// Describe implements the prometheus.Collector interface.
+func (m *GRPCMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.duration.Describe(ch)
+	m.requests.Describe(ch)
+}
+
+// Collect implements the prometheus.Collector interface.
+func (m *GRPCMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.duration.Collect(ch)
+	m.requests.Collect(ch)
+}
+
+// UnaryInterceptor returns an interceptor to measure grpc unary call.
+func (m *GRPCMetrics) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		m.duration.WithLabelValues(info.FullMethod).Observe(time.Since(start).Seconds())
+		m.requests.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+		return resp, err
+	}
+}
+
+// ChainUnaryInterceptors chains the interceptors into one, the first one is the outermost.
+func ChainUnaryInterceptors(interceptors ...grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		chained := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, next := interceptors[i], chained
+			chained = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return interceptor(ctx, req, info, next)
+			}
+		}
+		return chained(ctx, req)
+	}
+}
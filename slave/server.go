@@ -1,15 +1,22 @@
 package slave
 
 import (
-	"errors"
+	"fmt"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	proto "github.com/arkbriar/ssmgr/protocol"
 	ss "github.com/arkbriar/ssmgr/slave/shadowsocks"
+	protobuf "github.com/golang/protobuf/proto"
 	google_protobuf "github.com/golang/protobuf/ptypes/empty"
 	"golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 )
 
 type server struct {
@@ -27,20 +34,56 @@ func NewSSMgrSlaveServer(token string, mgr ss.Manager) proto.SSMgrSlaveServer {
 	}
 }
 
-func authorize(ctx context.Context, token string) error {
-	if md, ok := metadata.FromContext(ctx); ok {
-		if len(md["token"]) > 0 && md["token"][0] == token {
+// Auth describes what a master must present before its calls are handled.
+type Auth struct {
+	// Token is the shared token carried in the metadata of every call.
+	Token string
+	// PeerName pins the identity of the master. When it is not empty, the client certificate
+	// must carry it as common name or DNS name.
+	PeerName string
+}
+
+func authorizePeer(ctx context.Context, name string) error {
+	if len(name) == 0 {
+		return nil
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return status.Error(codes.Unauthenticated, "unknown peer")
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return status.Error(codes.Unauthenticated, "peer is not authenticated")
+	}
+	cert := info.State.VerifiedChains[0][0]
+	if cert.Subject.CommonName == name {
+		return nil
+	}
+	for _, dnsName := range cert.DNSNames {
+		if dnsName == name {
 			return nil
 		}
-		return errors.New("access denied")
 	}
-	return errors.New("empty metadata")
+	return status.Error(codes.PermissionDenied, "unexpected peer "+cert.Subject.CommonName)
+}
+
+func authorize(ctx context.Context, auth *Auth) error {
+	if err := authorizePeer(ctx, auth.PeerName); err != nil {
+		return err
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if len(md["token"]) > 0 && md["token"][0] == auth.Token {
+			return nil
+		}
+		return status.Error(codes.PermissionDenied, "access denied")
+	}
+	return status.Error(codes.Unauthenticated, "empty metadata")
 }
 
 // StreamAuthInterceptor returns an interceptor to do authorization for grpc stream call.
-func StreamAuthInterceptor(token string) grpc.StreamServerInterceptor {
+func StreamAuthInterceptor(auth *Auth) grpc.StreamServerInterceptor {
 	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
-		if err := authorize(stream.Context(), token); err != nil {
+		if err := authorize(stream.Context(), auth); err != nil {
 			return err
 		}
 		return handler(srv, stream)
@@ -48,33 +91,203 @@ func StreamAuthInterceptor(token string) grpc.StreamServerInterceptor {
 }
 
 // UnaryAuthInterceptor returns an interceptor to do authorization for grpc unary call.
-func UnaryAuthInterceptor(token string) grpc.UnaryServerInterceptor {
+func UnaryAuthInterceptor(auth *Auth) grpc.UnaryServerInterceptor {
 	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-		if err := authorize(ctx, token); err != nil {
+		if err := authorize(ctx, auth); err != nil {
 			return nil, err
 		}
 		return handler(ctx, req)
 	}
 }
 
+// portResource describes the port in error details.
+func portResource(port int32, description string) *errdetails.ResourceInfo {
+	return &errdetails.ResourceInfo{
+		ResourceType: "port",
+		ResourceName: fmt.Sprint(port),
+		Description:  description,
+	}
+}
+
+// statusError converts an error of `Manager` to a grpc status error with details of the port.
+func statusError(port int32, err error) error {
+	var code codes.Code
+	switch err {
+	case nil:
+		return nil
+	case ss.ErrServerExists:
+		code = codes.AlreadyExists
+	case ss.ErrServerNotFound:
+		code = codes.NotFound
+	case ss.ErrInvalidServer:
+		code = codes.InvalidArgument
+	default:
+		code = codes.Internal
+	}
+	return withDetails(status.New(code, err.Error()), portResource(port, err.Error()))
+}
+
+func withDetails(st *status.Status, details ...protobuf.Message) error {
+	if detailed, err := st.WithDetails(details...); err == nil {
+		return detailed.Err()
+	}
+	return st.Err()
+}
+
+func invalidServerError(port int32, violations []ss.Violation) error {
+	badRequest := &errdetails.BadRequest{}
+	for _, v := range violations {
+		badRequest.FieldViolations = append(badRequest.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field:       v.Field,
+			Description: v.Description,
+		})
+	}
+	st := status.New(codes.InvalidArgument, ss.ErrInvalidServer.Error())
+	return withDetails(st, portResource(port, "invalid allocation"), badRequest)
+}
+
+func conflictError(port int32, violations ...*errdetails.PreconditionFailure_Violation) error {
+	st := status.New(codes.AlreadyExists, ss.ErrServerExists.Error())
+	return withDetails(st, portResource(port, "allocated with different settings"),
+		&errdetails.PreconditionFailure{Violations: violations})
+}
+
+func quotaOf(r *proto.AllocateRequest) ss.Quota {
+	q := ss.Quota{MaxTraffic: r.GetMaxTraffic()}
+	if r.GetExpireTime() != 0 {
+		q.ExpireTime = time.Unix(0, r.GetExpireTime())
+	}
+	return q
+}
+
+func stateOf(s *ss.Server) proto.ServerState {
+	switch s.StoppedFor() {
+	case ss.StopReasonQuota:
+		return proto.ServerState_QUOTA_EXCEEDED
+	case ss.StopReasonExpired:
+		return proto.ServerState_EXPIRED
+	case ss.StopReasonSuspended:
+		return proto.ServerState_SUSPENDED
+	default:
+		return proto.ServerState_RUNNING
+	}
+}
+
+// Allocate is idempotent, allocating a port which is already allocated with the same password
+// and method succeeds, and updates the quota of the port.
 func (s *server) Allocate(ctx context.Context, r *proto.AllocateRequest) (*google_protobuf.Empty, error) {
 	server := &ss.Server{
-		Host:     "0.0.0.0",
+		Hosts:    ss.Hosts(r.GetBindAddresses()),
 		Port:     r.GetPort(),
 		Password: r.GetPassword(),
 		Method:   r.GetMethod(),
 		Timeout:  60,
+		Quota:    quotaOf(r),
+		ACLRules: r.GetAclRules(),
+	}
+	if len(server.Hosts) == 0 {
+		server.Hosts = ss.Hosts{"0.0.0.0"}
+	}
+	if r.GetIpv6First() {
+		server.WithIPv6First()
 	}
 
 	log.Debugf("Recv allocate request: %v", r)
 
-	return &google_protobuf.Empty{}, s.mgr.Add(server)
+	if violations := server.Validate(); len(violations) != 0 {
+		return nil, invalidServerError(server.Port, violations)
+	}
+
+	err := s.mgr.Add(server)
+	if err != ss.ErrServerExists {
+		return &google_protobuf.Empty{}, statusError(server.Port, err)
+	}
+
+	existing, err := s.mgr.GetServer(server.Port)
+	if err != nil {
+		// removed right after the failed add
+		return nil, statusError(server.Port, ss.ErrServerExists)
+	}
+	var violations []*errdetails.PreconditionFailure_Violation
+	if existing.Password != server.Password {
+		violations = append(violations, &errdetails.PreconditionFailure_Violation{
+			Type:        "PASSWORD",
+			Subject:     fmt.Sprint(server.Port),
+			Description: "port is allocated with another password",
+		})
+	}
+	if existing.Method != server.Method {
+		violations = append(violations, &errdetails.PreconditionFailure_Violation{
+			Type:        "METHOD",
+			Subject:     fmt.Sprint(server.Port),
+			Description: "port is allocated with method " + existing.Method,
+		})
+	}
+	if !existing.Hosts.Equal(server.Hosts) {
+		violations = append(violations, &errdetails.PreconditionFailure_Violation{
+			Type:        "BIND_ADDRESSES",
+			Subject:     fmt.Sprint(server.Port),
+			Description: fmt.Sprintf("port is bound to %v", []string(existing.Hosts)),
+		})
+	}
+	if existing.IPv6First() != server.IPv6First() {
+		violations = append(violations, &errdetails.PreconditionFailure_Violation{
+			Type:        "IPV6_FIRST",
+			Subject:     fmt.Sprint(server.Port),
+			Description: fmt.Sprintf("port is allocated with ipv6_first %t", existing.IPv6First()),
+		})
+	}
+	if len(violations) != 0 {
+		return nil, conflictError(server.Port, violations...)
+	}
+	if !existing.Quota.Equal(server.Quota) {
+		if err := s.mgr.SetQuota(server.Port, server.Quota); err != nil {
+			return nil, statusError(server.Port, err)
+		}
+	}
+	if proto.ACLDigest(existing.ACLRules) != proto.ACLDigest(server.ACLRules) {
+		if err := s.mgr.SetACL(server.Port, server.ACLRules); err != nil {
+			return nil, statusError(server.Port, err)
+		}
+	}
+	return &google_protobuf.Empty{}, nil
 }
 
+// Free is idempotent, freeing a port which is not allocated succeeds.
 func (s *server) Free(ctx context.Context, r *proto.FreeRequest) (*google_protobuf.Empty, error) {
 	log.Debugf("Recv free request: %v", r)
 
-	return &google_protobuf.Empty{}, s.mgr.Remove(r.GetPort())
+	err := s.mgr.Remove(r.GetPort())
+	if err == ss.ErrServerNotFound {
+		log.Debugf("Port %d is already free", r.GetPort())
+		return &google_protobuf.Empty{}, nil
+	}
+	return &google_protobuf.Empty{}, statusError(r.GetPort(), err)
+}
+
+// Suspend is idempotent, suspending a suspended port succeeds.
+func (s *server) Suspend(ctx context.Context, r *proto.SuspendRequest) (*google_protobuf.Empty, error) {
+	log.Debugf("Recv suspend request: %v", r)
+
+	mode := ss.SuspendStop
+	if r.GetMode() == proto.SuspendMode_REJECT {
+		mode = ss.SuspendReject
+	}
+	return &google_protobuf.Empty{}, statusError(r.GetPort(), s.mgr.Suspend(r.GetPort(), mode))
+}
+
+// Resume is idempotent, resuming a port which is not suspended succeeds.
+func (s *server) Resume(ctx context.Context, r *proto.ResumeRequest) (*google_protobuf.Empty, error) {
+	log.Debugf("Recv resume request: %v", r)
+
+	return &google_protobuf.Empty{}, statusError(r.GetPort(), s.mgr.Resume(r.GetPort()))
+}
+
+// SetACL sets the acl of an allocated port, without interrupting the allocation.
+func (s *server) SetACL(ctx context.Context, r *proto.SetACLRequest) (*google_protobuf.Empty, error) {
+	log.Debugf("Recv set acl request: %v", r)
+
+	return &google_protobuf.Empty{}, statusError(r.GetPort(), s.mgr.SetACL(r.GetPort(), r.GetRules()))
 }
 
 func (s *server) GetStats(ctx context.Context, _ *google_protobuf.Empty) (*proto.Statistics, error) {
@@ -85,6 +298,9 @@ func (s *server) GetStats(ctx context.Context, _ *google_protobuf.Empty) (*proto
 		flow[port] = &proto.FlowUnit{
 			Traffic:   server.GetStat().Traffic,
 			StartTime: server.Extra.StartTime.UnixNano(),
+			Epoch:     server.Extra.Epoch,
+			State:     stateOf(server),
+			AclDigest: proto.ACLDigest(server.ACLRules),
 		}
 	}
 
@@ -0,0 +1,29 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"os"
+)
+
+// aclFileContent returns the acl file of ss-server, which accepts all destinations except the
+// ones in the outbound block list.
+func aclFileContent(rules []string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("[accept_all]\n\n[outbound_block_list]\n")
+	for _, rule := range rules {
+		buf.WriteString(rule)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// writeACL writes the acl file for ss-server, or removes it when there's no rules.
+func (s *Server) writeACL(filename string) error {
+	if len(s.ACLRules) == 0 {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return writeFileAtomic(filename, aclFileContent(s.ACLRules), 0644)
+}
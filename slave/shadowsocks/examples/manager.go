@@ -12,7 +12,7 @@ import (
 
 func addServers(mgr ss.Manager, ports ...int32) {
 	s := &ss.Server{
-		Host:     "0.0.0.0",
+		Hosts:    ss.Hosts{"0.0.0.0"},
 		Password: "SomePass",
 		Method:   "aes-256-cfb",
 		Timeout:  60,
@@ -38,7 +38,7 @@ func contextMain(ctx context.Context) {
 		return
 	default:
 	}
-	mgr := ss.NewManager(6001)
+	mgr := ss.NewManager(ss.DefaultStateDir(), 6001)
 	defer mgr.CleanUp()
 	err := mgr.Restore()
 	if err != nil {
@@ -12,8 +12,11 @@ import (
 	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
+	rpc "github.com/arkbriar/ssmgr/protocol"
 )
 
 // Errors of `Manager`
@@ -27,7 +30,7 @@ var (
 // servers.
 type Manager interface {
 	// Listen listens udp connection on 127.0.0.1:{udpPort} and handles the stats update
-	// sent from ss-server.
+	// sent from ss-server. It also stops the servers exceeding their quota until ctx is done.
 	Listen(ctx context.Context) error
 	// Add adds a ss-server with given arguments.
 	Add(s *Server) error
@@ -37,36 +40,132 @@ type Manager interface {
 	ListServers() map[int32]*Server
 	// GetServer gets a clone of `Server` struct of given port.
 	GetServer(port int32) (*Server, error)
-	// Restore all stopped servers, this must be called before any other actions.
+	// SetQuota sets the quota of the server, and starts it if it's stopped for the quota
+	// which is no longer exceeded.
+	SetQuota(port int32, q Quota) error
+	// Suspend stops serving the port, but keeps its config, reservation and traffic. A port
+	// already suspended is left as is.
+	Suspend(port int32, mode SuspendMode) error
+	// Resume serves the suspended port again, a port not suspended is left as is.
+	Resume(port int32) error
+	// SetACL sets the destinations blocked on the port, the ss-server is restarted to load
+	// them if it's running. The port keeps its config, reservation and traffic.
+	SetACL(port int32, rules []string) error
+	// Restore all servers in the state file, this must be called before any other actions.
 	Restore() error
 	// CleanUp removes all servers and files.
 	CleanUp()
+	// PacketStats returns the counters of stat packets sent from ss-servers.
+	PacketStats() PacketStats
+}
+
+// PacketStats counts the stat packets received by `Manager`.
+type PacketStats struct {
+	Received int64
+	Dropped  int64
 }
 
 // Implementation of `Manager` interface.
 type manager struct {
+	// counters of stat packets, accessed atomically and kept first for alignment
+	statReceived int64
+	statDropped  int64
+	// dirty is set when the state of any server is changed but not saved, accessed atomically
+	dirty int32
+	// restoring is set while Restore runs, so that the state file isn't overwritten with the
+	// servers restored so far, accessed atomically
+	restoring int32
+
 	serverMu sync.RWMutex
 	servers  map[int32]*Server
 	path     string
 	udpPort  int
+	storeMu  sync.Mutex
+	store    *stateStore
+}
+
+// DefaultStateDir returns the default directory to store the state and files of servers.
+func DefaultStateDir() string {
+	return path.Join(os.Getenv("HOME"), ".ssmgr")
 }
 
-// NewManager returns a new manager, udpPort is origin shadowsocks manager api port, receiving
-// 'stat' command from ss-servers
-func NewManager(udpPort int) Manager {
+// NewManager returns a new manager managing servers under dir, udpPort is origin shadowsocks
+// manager api port, receiving 'stat' command from ss-servers
+func NewManager(dir string, udpPort int) Manager {
 	mgr := &manager{
 		servers: make(map[int32]*Server),
-		path:    path.Join(os.Getenv("HOME"), ".ssmgr"),
+		path:    dir,
 		udpPort: udpPort,
+		store:   &stateStore{dir: dir},
 	}
 	return mgr
 }
 
+func (mgr *manager) markDirty() {
+	atomic.StoreInt32(&mgr.dirty, 1)
+}
+
+// saveLocked saves the states of all servers to the state file, serverMu must be held. Saving is
+// deferred to the end of Restore while it runs.
+func (mgr *manager) saveLocked() {
+	if atomic.LoadInt32(&mgr.restoring) == 1 {
+		mgr.markDirty()
+		return
+	}
+
+	mgr.storeMu.Lock()
+	defer mgr.storeMu.Unlock()
+
+	// changes made while saving mark it dirty again
+	atomic.StoreInt32(&mgr.dirty, 0)
+
+	states := make(map[int32]*serverState, len(mgr.servers))
+	for port, s := range mgr.servers {
+		states[port] = s.state()
+	}
+	if err := mgr.store.Save(states); err != nil {
+		log.Warnf("Can not save state, %s", err)
+		mgr.markDirty()
+	}
+}
+
+// flushInterval is the interval to save the state changed in background, such as traffic.
+const flushInterval = 5 * time.Second
+
+func (mgr *manager) flushLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(flushInterval):
+			if atomic.LoadInt32(&mgr.dirty) == 0 {
+				continue
+			}
+			mgr.serverMu.RLock()
+			mgr.saveLocked()
+			mgr.serverMu.RUnlock()
+		}
+	}
+}
+
 func (mgr *manager) handleStat(data []byte) {
+	atomic.AddInt64(&mgr.statReceived, 1)
+	if !mgr.updateStat(data) {
+		atomic.AddInt64(&mgr.statDropped, 1)
+	}
+}
+
+// updateStat parses the stat packet and updates the statistic of the server, it returns false if
+// the packet is dropped.
+func (mgr *manager) updateStat(data []byte) bool {
+	if len(data) < 5 {
+		log.Warnf("Packet too short, dropped")
+		return false
+	}
 	cmd := string(data[:4])
 	if string(data[:4]) != "stat" {
 		log.Warnf("Unrecognized command %s, dropped", cmd)
-		return
+		return false
 	}
 
 	var stat map[string]int64
@@ -75,7 +174,7 @@ func (mgr *manager) handleStat(data []byte) {
 	err := json.Unmarshal(body, &stat)
 	if err != nil {
 		log.Warnln("Unmarshal error:", err)
-		return
+		return false
 	}
 
 	port, traffic := -1, int64(-1)
@@ -86,7 +185,7 @@ func (mgr *manager) handleStat(data []byte) {
 	}
 	if port < 0 || traffic < 0 {
 		log.Warnf("Invalid stat!")
-		return
+		return false
 	}
 
 	// update statistic
@@ -96,9 +195,10 @@ func (mgr *manager) handleStat(data []byte) {
 	s, ok := mgr.servers[int32(port)]
 	if !ok {
 		log.Warnf("Server on port %d not found!", port)
-		return
+		return false
 	}
-	s.updateStat(Stat{Traffic: traffic})
+	s.updateTraffic(traffic)
+	return true
 }
 
 func (mgr *manager) managerAddress() string {
@@ -123,6 +223,9 @@ func (mgr *manager) Listen(ctx context.Context) error {
 		return err
 	}
 
+	go mgr.enforceLoop(ctx)
+	go mgr.flushLoop(ctx)
+
 	go func() {
 		defer conn.Close()
 
@@ -151,6 +254,133 @@ func (mgr *manager) Listen(ctx context.Context) error {
 	return nil
 }
 
+// enforceInterval is the interval to check quota of servers.
+const enforceInterval = 10 * time.Second
+
+func (mgr *manager) enforceLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-time.After(enforceInterval):
+			mgr.enforce(now)
+		}
+	}
+}
+
+// enforce stops the running servers exceeding their quota.
+func (mgr *manager) enforce(now time.Time) {
+	mgr.serverMu.RLock()
+	defer mgr.serverMu.RUnlock()
+
+	stopped := false
+	for port, s := range mgr.servers {
+		if s.StoppedFor() != StopReasonNone {
+			continue
+		}
+		reason := s.Quota.exceeded(s.GetStat().Traffic, now)
+		if reason == StopReasonNone {
+			continue
+		}
+		if err := s.stopFor(reason); err != nil {
+			log.Warnf("Can not stop server(%d) for %s, %s", port, reason, err)
+		} else {
+			log.Infof("Server(%d) is stopped for %s", port, reason)
+			stopped = true
+		}
+	}
+	if stopped {
+		mgr.saveLocked()
+	}
+}
+
+func (mgr *manager) SetQuota(port int32, q Quota) error {
+	mgr.serverMu.Lock()
+	defer mgr.serverMu.Unlock()
+
+	s, ok := mgr.servers[port]
+	if !ok {
+		return ErrServerNotFound
+	}
+	s.Quota = q
+	defer mgr.saveLocked()
+
+	reason := s.StoppedFor()
+	if (reason == StopReasonQuota || reason == StopReasonExpired) &&
+		q.exceeded(s.GetStat().Traffic, time.Now()) == StopReasonNone {
+		log.Infof("Quota of server(%d) is raised, start it", port)
+
+		return s.resume()
+	}
+	return nil
+}
+
+func (mgr *manager) Suspend(port int32, mode SuspendMode) error {
+	mgr.serverMu.RLock()
+	defer mgr.serverMu.RUnlock()
+
+	s, ok := mgr.servers[port]
+	if !ok {
+		return ErrServerNotFound
+	}
+	if s.StoppedFor() == StopReasonSuspended {
+		return nil
+	}
+	if err := s.suspend(mode); err != nil {
+		return err
+	}
+	mgr.saveLocked()
+
+	log.Infof("Suspend server(%d), mode %s", port, mode)
+
+	return nil
+}
+
+func (mgr *manager) Resume(port int32) error {
+	mgr.serverMu.RLock()
+	defer mgr.serverMu.RUnlock()
+
+	s, ok := mgr.servers[port]
+	if !ok {
+		return ErrServerNotFound
+	}
+	if s.StoppedFor() != StopReasonSuspended {
+		return nil
+	}
+	if err := s.resume(); err != nil {
+		return err
+	}
+	mgr.saveLocked()
+
+	log.Infof("Resume server(%d)", port)
+
+	return nil
+}
+
+func (mgr *manager) SetACL(port int32, rules []string) error {
+	for _, rule := range rules {
+		if rpc.ValidACLRule(rule) != nil {
+			return ErrInvalidServer
+		}
+	}
+
+	mgr.serverMu.RLock()
+	defer mgr.serverMu.RUnlock()
+
+	s, ok := mgr.servers[port]
+	if !ok {
+		return ErrServerNotFound
+	}
+	if err := s.setACL(rules); err != nil {
+		return err
+	}
+	mgr.saveLocked()
+
+	log.Infof("Set acl of server(%d), %d rules", port, len(rules))
+
+	return nil
+}
+
 func (mgr *manager) addAlive(s *Server) error {
 	mgr.serverMu.Lock()
 	defer mgr.serverMu.Unlock()
@@ -166,7 +396,7 @@ func (mgr *manager) prepareServer(s *Server) *Server {
 	runPath := path.Join(mgr.path, fmt.Sprint(s.Port))
 	s = s.clone().WithDefaults().WithRunPath(runPath).WithPidFile(
 		path.Join(runPath, "ss_server.pid"),
-	).WithManagerAddress(mgr.managerAddress())
+	).WithManagerAddress(mgr.managerAddress()).WithChangeHook(mgr.markDirty)
 	return s
 }
 
@@ -190,6 +420,7 @@ func (mgr *manager) Add(s *Server) error {
 		return err
 	}
 	mgr.servers[s.Port] = s
+	mgr.saveLocked()
 
 	log.Infof("Add server(%s)", s)
 
@@ -210,6 +441,7 @@ func (mgr *manager) Remove(port int32) error {
 		log.Warn(err)
 	}
 	os.RemoveAll(s.runPath)
+	mgr.saveLocked()
 
 	log.Infof("Remove server(%s)", s)
 
@@ -264,28 +496,33 @@ func readDirNames(dirname string) ([]string, error) {
 	return names, nil
 }
 
-func (mgr *manager) restore(s *Server, serverPath string) error {
-	if !validPort(s.Port) {
-		log.Warn("Invalid port")
-	}
-
-	s = mgr.prepareServer(s)
-	err := s.Restore(serverPath)
-	if err != nil {
+func (mgr *manager) restore(st *serverState) error {
+	s := mgr.prepareServer(st.Server)
+	if err := s.restore(st); err != nil {
 		return err
 	}
 
-	// when server process is alive
-	if s.Alive() {
+	// when server process is alive, or the server is stopped by manager
+	if s.Alive() || s.StoppedFor() != StopReasonNone {
 		if err := mgr.addAlive(s); err != nil {
 			return err
 		}
 		return nil
 	}
 
-	// when server process is dead
-	err = mgr.Add(s)
-	if err != nil {
+	// when server process is dead, start it without saving, the state file is saved once all
+	// servers are restored
+	if !s.valid() {
+		return ErrInvalidServer
+	}
+	if err := os.MkdirAll(s.runPath, 0744); err != nil {
+		return err
+	}
+	if err := s.Start(); err != nil {
+		return err
+	}
+	if err := mgr.addAlive(s); err != nil {
+		s.Stop()
 		return err
 	}
 
@@ -294,38 +531,47 @@ func (mgr *manager) restore(s *Server, serverPath string) error {
 	return nil
 }
 
-// Restore starts all ss-servers that leaves their dirs in managed path.
+// Restore starts all ss-servers saved in the state file. Servers can not be restored are
+// quarantined, so they're never lost silently.
 func (mgr *manager) Restore() error {
-	if _, err := os.Stat(mgr.path); err != nil {
-		return errors.New(mgr.path + " doesn't not exsits")
+	if err := os.MkdirAll(mgr.path, 0755); err != nil {
+		return err
 	}
 	if !isDir(mgr.path) {
 		return errors.New(mgr.path + " is not a directory")
 	}
 
-	// traverse all dirs in managed path and restore the servers.
-	names, err := readDirNames(mgr.path)
+	states, err := mgr.store.Load()
 	if err != nil {
 		return err
 	}
-	for _, name := range names {
-		serverPath := path.Join(mgr.path, name)
-		if isDir(serverPath) {
-			if port, ok := getPort(name); ok {
-				log.Infof("Restoring server(%d)", port)
 
-				err := mgr.restore(&Server{Port: port}, serverPath)
-				if err != nil {
-					log.Warnf("Can not restore server(%d), %s. Remove it", port, err)
-					os.RemoveAll(serverPath)
-				}
-			} else {
-				log.Warnf("Ignore unrecognized port %s", name)
-			}
-		} else {
-			log.Warnf("Ignore normal file %s", serverPath)
+	// the state file is only saved after all servers are restored, so that it's never left with
+	// part of them if slave dies while restoring
+	atomic.StoreInt32(&mgr.restoring, 1)
+	ports := make([]int, 0, len(states))
+	for port := range states {
+		ports = append(ports, int(port))
+	}
+	sort.Ints(ports)
+
+	for _, p := range ports {
+		port := int32(p)
+		log.Infof("Restoring server(%d)", port)
+
+		if err := mgr.restore(states[port]); err != nil {
+			log.Warnf("Can not restore server(%d), %s. Quarantine it", port, err)
+			data, _ := json.Marshal(states[port])
+			mgr.store.quarantine(fmt.Sprint(port), data)
 		}
 	}
+
+	atomic.StoreInt32(&mgr.restoring, 0)
+
+	mgr.serverMu.RLock()
+	defer mgr.serverMu.RUnlock()
+
+	mgr.saveLocked()
 	return nil
 }
 
@@ -335,6 +581,10 @@ func (mgr *manager) CleanUp() {
 		log.Warn(err)
 	}
 	for _, name := range names {
+		// keep the quarantined files for inspection
+		if name == quarantineDirName {
+			continue
+		}
 		os.RemoveAll(path.Join(mgr.path, name))
 	}
 	for p := range mgr.ListServers() {
@@ -343,3 +593,10 @@ func (mgr *manager) CleanUp() {
 
 	log.Infof("Clean up all managed servers")
 }
+
+func (mgr *manager) PacketStats() PacketStats {
+	return PacketStats{
+		Received: atomic.LoadInt64(&mgr.statReceived),
+		Dropped:  atomic.LoadInt64(&mgr.statDropped),
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"os/user"
@@ -18,13 +19,15 @@ import (
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	rpc "github.com/arkbriar/ssmgr/protocol"
 	proc "github.com/arkbriar/ssmgr/slave/shadowsocks/process"
 	"github.com/coreos/go-iptables/iptables"
 )
 
 var (
-	ipt *iptables.IPTables
-	usr *user.User
+	ipt  *iptables.IPTables
+	ip6t *iptables.IPTables
+	usr  *user.User
 )
 
 func init() {
@@ -39,6 +42,9 @@ func init() {
 		usr, _ = user.Current()
 		if usr.Name == "root" {
 			ipt, _ = iptables.New()
+			if ip6t, _ = iptables.NewWithProtocol(iptables.ProtocolIPv6); ip6t == nil {
+				log.Warnf("ip6tables is not available, suspended ports on IPv6 are stopped instead of rejected")
+			}
 		} else {
 			log.Warnf("Connection limit and auto ban is only supported when running with root")
 		}
@@ -128,16 +134,133 @@ func (rt *serverRuntime) alive() bool {
 }
 
 type serverExtra struct {
+	// StartTime is when the server is first started, it's kept across restarts.
 	StartTime time.Time `json:"start_time"`
+	// Epoch increases every time the process of the server is restarted.
+	Epoch int64 `json:"epoch"`
+	// StopReason is set when the server is stopped by manager but still managed.
+	StopReason StopReason `json:"stop_reason,omitempty"`
+	// SuspendMode is how the server is suspended, when StopReason is StopReasonSuspended.
+	SuspendMode SuspendMode `json:"suspend_mode,omitempty"`
+}
+
+// StopReason tells why a managed server is stopped.
+type StopReason string
+
+// Reasons to stop a managed server.
+const (
+	StopReasonNone    StopReason = ""
+	StopReasonQuota   StopReason = "quota"
+	StopReasonExpired StopReason = "expired"
+	// the port is suspended, it's either stopped or rejected, see SuspendMode
+	StopReasonSuspended StopReason = "suspended"
+)
+
+// SuspendMode is how a suspended port is kept from being served.
+type SuspendMode string
+
+// Modes to suspend a port.
+const (
+	// SuspendStop stops the process of ss-server.
+	SuspendStop SuspendMode = "stop"
+	// SuspendReject keeps the process running, and rejects connections to the port with iptables.
+	// It falls back to SuspendStop when iptables is not supported.
+	SuspendReject SuspendMode = "reject"
+)
+
+// Quota limits the traffic and lifetime of a server, zero values mean unlimited.
+type Quota struct {
+	// MaxTraffic is the traffic in bytes allowed since the server is first started.
+	MaxTraffic int64     `json:"max_traffic,omitempty"`
+	ExpireTime time.Time `json:"expire_time,omitempty"`
+}
+
+// Equal reports whether the quotas are the same.
+func (q Quota) Equal(o Quota) bool {
+	return q.MaxTraffic == o.MaxTraffic && q.ExpireTime.Equal(o.ExpireTime)
+}
+
+// exceeded returns the reason to stop a server with the traffic at the time, or
+// StopReasonNone if the quota is not exceeded.
+func (q Quota) exceeded(traffic int64, now time.Time) StopReason {
+	if q.MaxTraffic > 0 && traffic >= q.MaxTraffic {
+		return StopReasonQuota
+	}
+	if !q.ExpireTime.IsZero() && !now.Before(q.ExpireTime) {
+		return StopReasonExpired
+	}
+	return StopReasonNone
+}
+
+// trafficCounter accumulates the traffic over all processes of a server, it's kept in the state
+// file so that traffic survives the restarts of both ss-server and slave.
+type trafficCounter struct {
+	// Base is the traffic transferred by the previous processes.
+	Base int64 `json:"base"`
+	// Last is the traffic last reported by the current process.
+	Last int64 `json:"last"`
+}
+
+// Hosts are the addresses a server binds to, e.g. both "0.0.0.0" and "::" for dual stack.
+// It's marshaled as a string when there's only one address, which all versions of ss-server
+// read.
+type Hosts []string
+
+// MarshalJSON implements the json.Marshaler interface.
+func (h Hosts) MarshalJSON() ([]byte, error) {
+	if len(h) == 1 {
+		return json.Marshal(h[0])
+	}
+	return json.Marshal([]string(h))
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (h *Hosts) UnmarshalJSON(data []byte) error {
+	var host string
+	if err := json.Unmarshal(data, &host); err == nil {
+		*h = Hosts{host}
+		return nil
+	}
+	var hosts []string
+	if err := json.Unmarshal(data, &hosts); err != nil {
+		return err
+	}
+	*h = hosts
+	return nil
+}
+
+// hasIPv6 reports whether any of the hosts is an IPv6 address.
+func (h Hosts) hasIPv6() bool {
+	for _, host := range h {
+		if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Equal reports whether the hosts are the same, in the same order.
+func (h Hosts) Equal(o Hosts) bool {
+	if len(h) != len(o) {
+		return false
+	}
+	for i := range h {
+		if h[i] != o[i] {
+			return false
+		}
+	}
+	return true
 }
 
 // Server represents a ss-server instance.
 type Server struct {
-	Host        string       `json:"server"`
+	Hosts       Hosts        `json:"server"`
 	Port        int32        `json:"server_port"`
 	Password    string       `json:"password"`
 	Method      string       `json:"method"`
 	Timeout     int          `json:"timeout"`
+	Quota       Quota        `json:"quota"`
+	ACLRules    []string     `json:"acl_rules,omitempty"`
 	Extra       *serverExtra `json:"extra,omitempty"`
 	opts        serverOptions
 	connLimit   int
@@ -145,10 +268,15 @@ type Server struct {
 		enable bool
 		cancel context.CancelFunc
 	}
-	rtMu    sync.RWMutex
-	runPath string
-	runtime *serverRuntime
-	stat    atomic.Value
+	rtMu      sync.RWMutex
+	runPath   string
+	runtime   *serverRuntime
+	restarts  int
+	counterMu sync.Mutex
+	counter   trafficCounter
+	stat      atomic.Value
+	// onChange is called when the durable state of the server is changed.
+	onChange func()
 }
 
 // WithUDPRelay enables udp relay.
@@ -163,6 +291,11 @@ func (s *Server) WithIPv6First() *Server {
 	return s
 }
 
+// IPv6First returns if the server resolves to ipv6 first.
+func (s *Server) IPv6First() bool {
+	return s.opts.IPv6First
+}
+
 // WithMPTCP enables MPTCP.
 func (s *Server) WithMPTCP() *Server {
 	s.opts.MPTCP = true
@@ -244,6 +377,13 @@ func (s *Server) WithRunPath(runPath string) *Server {
 	return s
 }
 
+// WithChangeHook sets the function called when the durable state of the server is changed,
+// it must not block or call back into the server.
+func (s *Server) WithChangeHook(f func()) *Server {
+	s.onChange = f
+	return s
+}
+
 // WithDefaults sets the default options for the server.
 func (s *Server) WithDefaults() *Server {
 	return s.WithConnLimit(32).
@@ -261,14 +401,57 @@ func (s *Server) args() []string {
 	var args []string
 	if len(s.runPath) != 0 {
 		args = []string{"-c", path.Join(s.runPath, "ss_server.conf")}
+		if len(s.ACLRules) != 0 {
+			args = append(args, "--acl", path.Join(s.runPath, "ss_server.acl"))
+		}
 	} else {
-		args = []string{"-s", s.Host, "-p", fmt.Sprint(s.Port), "-m", s.Method, "-k", s.Password, "-d", fmt.Sprint(s.Timeout)}
+		for _, host := range s.Hosts {
+			args = append(args, "-s", host)
+		}
+		args = append(args, "-p", fmt.Sprint(s.Port), "-m", s.Method, "-k", s.Password, "-d", fmt.Sprint(s.Timeout))
 	}
 	return append(args, s.opts.args()...)
 }
 
+// Violation describes an invalid field of a server.
+type Violation struct {
+	Field       string
+	Description string
+}
+
+// Validate returns the violations found in the server's configuration.
+func (s *Server) Validate() []Violation {
+	var violations []Violation
+	if len(s.Hosts) == 0 {
+		violations = append(violations, Violation{"server", "host is empty"})
+	}
+	for _, host := range s.Hosts {
+		if net.ParseIP(host) == nil {
+			violations = append(violations, Violation{"server", host + " is not an ip address"})
+		}
+	}
+	if !validPort(s.Port) {
+		violations = append(violations, Violation{"server_port", "port is out of range"})
+	}
+	if len(s.Password) < 8 {
+		violations = append(violations, Violation{"password", "password is shorter than 8"})
+	}
+	if !validEncryptMethod(s.Method) {
+		violations = append(violations, Violation{"method", "method is not supported"})
+	}
+	if s.Timeout <= 0 {
+		violations = append(violations, Violation{"timeout", "timeout is not positive"})
+	}
+	for _, rule := range s.ACLRules {
+		if err := rpc.ValidACLRule(rule); err != nil {
+			violations = append(violations, Violation{"acl_rules", err.Error()})
+		}
+	}
+	return violations
+}
+
 func (s *Server) valid() bool {
-	return len(s.Host) != 0 && validPort(s.Port) && len(s.Password) >= 8 && validEncryptMethod(s.Method) && s.Timeout > 0
+	return len(s.Validate()) == 0
 }
 
 // command constructs a new shadowsock server command
@@ -287,6 +470,7 @@ func (s *Server) clone() *Server {
 
 	c := *s
 	c.rtMu = sync.RWMutex{}
+	c.counterMu = sync.Mutex{}
 	return &c
 }
 
@@ -393,6 +577,72 @@ func (s *Server) checkConnLimit() (bool, error) {
 	return ipt.Exists("filter", "INPUT", s.connLimitIPTablesRule()...)
 }
 
+func (s *Server) rejectIPTablesRules() [][]string {
+	comment := fmt.Sprintf("SS_SUSPEND(%d)", s.Port)
+	return [][]string{
+		{"-p", "tcp", "--dport", fmt.Sprint(s.Port), "-j", "REJECT", "--reject-with", "tcp-reset",
+			"-m", "comment", "--comment", comment},
+		{"-p", "udp", "--dport", fmt.Sprint(s.Port), "-j", "REJECT",
+			"-m", "comment", "--comment", comment},
+	}
+}
+
+// createReject inserts the rules rejecting the port before any other rules, in ip6tables as well
+// if the server binds to an IPv6 address.
+func (s *Server) createReject() error {
+	if ipt == nil || (s.Hosts.hasIPv6() && ip6t == nil) {
+		return errIPTablesNotSupported
+	}
+
+	tables := []*iptables.IPTables{ipt}
+	if s.Hosts.hasIPv6() {
+		tables = append(tables, ip6t)
+	}
+	for _, t := range tables {
+		for _, rule := range s.rejectIPTablesRules() {
+			exists, err := t.Exists("filter", "INPUT", rule...)
+			if err != nil {
+				return err
+			}
+			if exists {
+				continue
+			}
+			if err := t.Insert("filter", "INPUT", 1, rule...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deleteReject deletes the rules rejecting the port from both iptables and ip6tables, the hosts
+// may be changed since they're created.
+func (s *Server) deleteReject() error {
+	if ipt == nil {
+		return errIPTablesNotSupported
+	}
+
+	tables := []*iptables.IPTables{ipt}
+	if ip6t != nil {
+		tables = append(tables, ip6t)
+	}
+	for _, t := range tables {
+		for _, rule := range s.rejectIPTablesRules() {
+			exists, err := t.Exists("filter", "INPUT", rule...)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				continue
+			}
+			if err := t.Delete("filter", "INPUT", rule...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func readPidFile(filename string) (int, error) {
 	pidname, err := ioutil.ReadFile(filename)
 	if err != nil {
@@ -425,18 +675,33 @@ func (s *Server) save(filename string) error {
 	return nil
 }
 
-func (s *Server) load(filename string) error {
-	data, err := ioutil.ReadFile(filename)
+// writeFileAtomic writes data to a temporary file and renames it to filename, so the file is
+// never left half written.
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	tmp := filename + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
 	if err != nil {
 		return err
 	}
-	return json.Unmarshal(data, s)
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
 }
 
 var (
 	errServerAlive          = errors.New("server is alive")
 	errServerAlreadyStarted = errors.New("server already started")
 	errServerNotStarted     = errors.New("server not started")
+	errServerNotStopped     = errors.New("server is not stopped by manager")
 )
 
 func (s *Server) exec() error {
@@ -512,13 +777,34 @@ func (s *Server) start() error {
 		return errors.New("start server without run path is not supported")
 	}
 
-	s.Extra = &serverExtra{
-		StartTime: time.Now(),
+	if s.Extra == nil {
+		s.Extra = &serverExtra{
+			StartTime: time.Now(),
+		}
+	} else {
+		// a new process counts from zero, keep the traffic of the previous ones
+		extra := &serverExtra{
+			StartTime: s.Extra.StartTime,
+			Epoch:     s.Extra.Epoch + 1,
+		}
+		// a rejected port stays rejected when its process is revived
+		if s.Extra.SuspendMode == SuspendReject {
+			extra.StopReason, extra.SuspendMode = s.Extra.StopReason, s.Extra.SuspendMode
+		}
+		s.Extra = extra
+		s.rollCounter()
 	}
+	s.changed()
+
+	// ss-server reads its config and acl from run path
 	err := s.save(path.Join(s.runPath, "ss_server.conf"))
 	if err != nil {
 		return err
 	}
+	err = s.writeACL(path.Join(s.runPath, "ss_server.acl"))
+	if err != nil {
+		return err
+	}
 
 	// execute and run actions after start
 	err = s.exec()
@@ -547,7 +833,7 @@ func (s *Server) kill() error {
 	}
 
 	proc := s.runtime.proc
-	s.runtime, s.Extra = nil, nil
+	s.runtime = nil
 	proc.Kill()
 	proc.Wait()
 	return nil
@@ -559,7 +845,7 @@ func (s *Server) forceKill() {
 	}
 
 	proc := s.runtime.proc
-	s.runtime, s.Extra = nil, nil
+	s.runtime = nil
 	proc.Kill()
 	proc.Wait()
 }
@@ -578,6 +864,13 @@ func (s *Server) beforeStop() {
 			log.Warn(err)
 		}
 	}
+
+	if s.Extra != nil && s.Extra.SuspendMode == SuspendReject {
+		err := s.deleteReject()
+		if err != nil && err != errIPTablesNotSupported {
+			log.Warn(err)
+		}
+	}
 }
 
 func (s *Server) stop() error {
@@ -599,9 +892,137 @@ func (s *Server) Restart() error {
 	defer s.rtMu.Unlock()
 
 	s.stop()
+	s.restarts++
 	return s.start()
 }
 
+// StoppedFor returns why the server is stopped by manager, or StopReasonNone if it's not.
+func (s *Server) StoppedFor() StopReason {
+	s.rtMu.RLock()
+	defer s.rtMu.RUnlock()
+
+	if s.Extra == nil {
+		return StopReasonNone
+	}
+	return s.Extra.StopReason
+}
+
+// stopFor stops the process of the server and records the reason, the server is kept with its
+// config and traffic.
+func (s *Server) stopFor(reason StopReason) error {
+	s.rtMu.Lock()
+	defer s.rtMu.Unlock()
+
+	if err := s.stop(); err != nil && err != errServerNotStarted {
+		return err
+	}
+	s.markStopped(reason, "")
+	return nil
+}
+
+// markStopped records the reason the server is stopped, rtMu must be held.
+func (s *Server) markStopped(reason StopReason, mode SuspendMode) {
+	extra := serverExtra{StartTime: time.Now()}
+	if s.Extra != nil {
+		extra = *s.Extra
+	}
+	extra.StopReason, extra.SuspendMode = reason, mode
+	s.Extra = &extra
+	s.changed()
+}
+
+// changed notifies that the durable state of the server is changed.
+func (s *Server) changed() {
+	if s.onChange != nil {
+		s.onChange()
+	}
+}
+
+// suspend stops serving the port in the given mode.
+func (s *Server) suspend(mode SuspendMode) error {
+	s.rtMu.Lock()
+	defer s.rtMu.Unlock()
+
+	if mode == SuspendReject {
+		if err := s.createReject(); err == errIPTablesNotSupported {
+			log.Warnf("Can not reject port %d without iptables, stop it instead", s.Port)
+			mode = SuspendStop
+		} else if err != nil {
+			return err
+		}
+	}
+	if mode != SuspendReject {
+		if err := s.stop(); err != nil && err != errServerNotStarted {
+			return err
+		}
+	}
+	s.markStopped(StopReasonSuspended, mode)
+	return nil
+}
+
+// resume serves the port stopped by manager again.
+func (s *Server) resume() error {
+	s.rtMu.Lock()
+	defer s.rtMu.Unlock()
+
+	if s.Extra == nil || s.Extra.StopReason == StopReasonNone {
+		return errServerNotStopped
+	}
+
+	// the process is still running when the port is rejected
+	if s.Extra.SuspendMode == SuspendReject {
+		if err := s.deleteReject(); err != nil && err != errIPTablesNotSupported {
+			return err
+		}
+		s.markStopped(StopReasonNone, "")
+		if s.runtime != nil && s.runtime.alive() {
+			return nil
+		}
+		s.runtime = nil
+	}
+	// start clears the stop reason
+	return s.start()
+}
+
+// setACL sets the destinations blocked, the running process is restarted to load them.
+func (s *Server) setACL(rules []string) error {
+	s.rtMu.Lock()
+	defer s.rtMu.Unlock()
+
+	s.ACLRules = rules
+	s.changed()
+
+	// loaded when it's started
+	if s.runtime == nil {
+		return nil
+	}
+	// a rejected port is not served, stop it so that it loads the rules when it's resumed
+	if s.Extra != nil && s.Extra.SuspendMode == SuspendReject {
+		if err := s.stop(); err != nil && err != errServerNotStarted {
+			return err
+		}
+		s.markStopped(StopReasonSuspended, SuspendStop)
+		return nil
+	}
+
+	s.stop()
+	s.restarts++
+	return s.start()
+}
+
+// Restarts returns how many times the server is restarted.
+func (s *Server) Restarts() int {
+	s.rtMu.RLock()
+	defer s.rtMu.RUnlock()
+
+	return s.restarts
+}
+
+// ConnLimit returns the connection limit of the port, 0 means unlimited.
+func (s *Server) ConnLimit() int {
+	return s.connLimit
+}
+
 // Alive returns if the server is alive
 func (s *Server) Alive() bool {
 	s.rtMu.RLock()
@@ -617,6 +1038,7 @@ func (s *Server) revive() error {
 
 	if s.runtime == nil || !s.runtime.alive() {
 		s.runtime = nil
+		s.restarts++
 		if err := s.start(); err != nil {
 			return err
 		}
@@ -626,11 +1048,11 @@ func (s *Server) revive() error {
 	return nil
 }
 
-func (s *Server) restoreRuntime(runPath string) error {
+func (s *Server) restoreRuntime(pid int) error {
 	s.rtMu.Lock()
 	defer s.rtMu.Unlock()
 
-	proc, err := findProcFromPidFile(path.Join(runPath, "ss_server.pid"))
+	proc, err := os.FindProcess(pid)
 	if err != nil {
 		return err
 	}
@@ -645,37 +1067,113 @@ func (s *Server) restoreRuntime(runPath string) error {
 	return nil
 }
 
-func (s *Server) restoreConf(runPath string) error {
-	return s.load(path.Join(runPath, "ss_server.conf"))
-}
-
-// Restore from files leaved.
-func (s *Server) Restore(runPath string) error {
-	err := s.restoreConf(runPath)
-	if err != nil {
-		return err
+// restore restores the server from its saved state, the process is adopted if it's still alive.
+func (s *Server) restore(st *serverState) error {
+	if st.Server == nil {
+		return errors.New("server is missing")
 	}
-	err = s.restoreRuntime(runPath)
-	if err != nil {
-		log.Warnf("Can not restore runtime of server (%s)", s)
-	} else {
-		if s.Alive() {
+	s.Hosts, s.Port, s.Password, s.Method, s.Timeout = st.Server.Hosts, st.Server.Port,
+		st.Server.Password, st.Server.Method, st.Server.Timeout
+	s.Quota, s.ACLRules, s.Extra = st.Server.Quota, st.Server.ACLRules, st.Server.Extra
+	s.opts.IPv6First = st.IPv6First
+
+	s.counterMu.Lock()
+	s.counter = st.Counter
+	s.stat.Store(Stat{Traffic: s.counter.Base + s.counter.Last})
+	s.counterMu.Unlock()
+
+	if st.Pid > 0 {
+		if err := s.restoreRuntime(st.Pid); err != nil {
+			log.Warnf("Can not restore runtime of server (%s)", s)
+		} else if s.Alive() {
 			s.afterStart()
 		}
 	}
-	s.runPath = runPath
+
+	// keep a rejected port from being served
+	if s.Extra != nil && s.Extra.SuspendMode == SuspendReject {
+		s.rtMu.Lock()
+		defer s.rtMu.Unlock()
+
+		if s.runtime != nil {
+			if err := s.createReject(); err == errIPTablesNotSupported {
+				log.Warnf("Can not reject port %d without iptables, stop it instead", s.Port)
+				if err := s.stop(); err != nil && err != errServerNotStarted {
+					log.Warnf("Can not stop server (%s), %s", s, err)
+				}
+				s.Extra.SuspendMode = SuspendStop
+			} else if err != nil {
+				log.Warnf("Can not reject port %d, %s", s.Port, err)
+			}
+		} else {
+			// nothing is listening on the port, it's the same as stopped
+			s.Extra.SuspendMode = SuspendStop
+		}
+	}
 	return nil
 }
 
+// state returns the durable state of the server.
+func (s *Server) state() *serverState {
+	s.rtMu.RLock()
+	defer s.rtMu.RUnlock()
+
+	st := &serverState{
+		Server: &Server{
+			Hosts:    s.Hosts,
+			Port:     s.Port,
+			Password: s.Password,
+			Method:   s.Method,
+			Timeout:  s.Timeout,
+			Quota:    s.Quota,
+			ACLRules: s.ACLRules,
+		},
+		IPv6First: s.opts.IPv6First,
+	}
+	if s.Extra != nil {
+		extra := *s.Extra
+		st.Server.Extra = &extra
+	}
+	if s.runtime != nil && s.runtime.alive() {
+		st.Pid = s.runtime.proc.Pid
+	}
+
+	s.counterMu.Lock()
+	st.Counter = s.counter
+	s.counterMu.Unlock()
+	return st
+}
+
 // Stat represents the statistics collected from a shadowsocks server
 type Stat struct {
-	Traffic int64 `json:"traffic"` // Transfered traffic in bytes
+	Traffic int64 `json:"traffic"` // Transfered traffic in bytes since the server is first started
 	/* Rx      int64 `json:"rx"`      // Receive in bytes
 	 * Tx      int64 `json:"tx"`      // Transmit in bytes */
 }
 
-func (s *Server) updateStat(stat Stat) {
-	s.stat.Store(stat)
+// rollCounter adds the traffic of the last process to base before a new process starts.
+func (s *Server) rollCounter() {
+	s.counterMu.Lock()
+	defer s.counterMu.Unlock()
+
+	s.counter.Base += s.counter.Last
+	s.counter.Last = 0
+	s.changed()
+}
+
+// updateTraffic updates the traffic with the counter reported by ss-server.
+func (s *Server) updateTraffic(reported int64) {
+	s.counterMu.Lock()
+	defer s.counterMu.Unlock()
+
+	// the counter goes back only when the process is restarted behind us
+	if reported < s.counter.Last {
+		s.counter.Base += s.counter.Last
+	}
+	s.counter.Last = reported
+	s.changed()
+
+	s.stat.Store(Stat{Traffic: s.counter.Base + s.counter.Last})
 }
 
 // GetStat returns the stats of the server.
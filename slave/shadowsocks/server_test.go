@@ -0,0 +1,98 @@
+package shadowsocks
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuotaExceeded(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+
+	cases := []struct {
+		name    string
+		quota   Quota
+		traffic int64
+		want    StopReason
+	}{
+		{"unlimited", Quota{}, 1 << 40, StopReasonNone},
+		{"under traffic", Quota{MaxTraffic: 100}, 99, StopReasonNone},
+		{"at traffic", Quota{MaxTraffic: 100}, 100, StopReasonQuota},
+		{"over traffic", Quota{MaxTraffic: 100}, 101, StopReasonQuota},
+		{"before expiry", Quota{ExpireTime: now.Add(time.Second)}, 0, StopReasonNone},
+		{"at expiry", Quota{ExpireTime: now}, 0, StopReasonExpired},
+		{"after expiry", Quota{ExpireTime: now.Add(-time.Second)}, 0, StopReasonExpired},
+		{"traffic before expiry", Quota{MaxTraffic: 100, ExpireTime: now.Add(-time.Second)}, 100, StopReasonQuota},
+		// master allows the traffic counted so far plus the remaining quota
+		{"cumulative plus remaining", Quota{MaxTraffic: 5000 + 300}, 5000 + 299, StopReasonNone},
+	}
+	for _, c := range cases {
+		if got := c.quota.exceeded(c.traffic, now); got != c.want {
+			t.Errorf("%s: exceeded(%d) = %q, want %q", c.name, c.traffic, got, c.want)
+		}
+	}
+}
+
+func TestTrafficCounter(t *testing.T) {
+	// each step is the traffic reported by ss-server, a restart of ss-server by the slave
+	// (restart), or a restart of the slave restoring the saved state (reload)
+	const (
+		restart = -1
+		reload  = -2
+	)
+
+	cases := []struct {
+		name  string
+		steps []int64
+		want  int64
+	}{
+		{"single process", []int64{10, 20, 30}, 30},
+		{"restarted by slave", []int64{10, 30, restart, 5, 15}, 45},
+		{"restarted behind slave", []int64{10, 30, 5, 15}, 45},
+		{"restarted twice", []int64{30, restart, 20, restart, 10}, 60},
+		{"slave reloaded", []int64{10, 30, reload, 40}, 40},
+		{"slave reloaded after restart", []int64{30, restart, 20, reload, 25}, 55},
+		{"process restarted while slave is down", []int64{30, reload, 5}, 35},
+		{"restart before any traffic", []int64{restart, restart, 10}, 10},
+	}
+	for _, c := range cases {
+		s := &Server{Hosts: Hosts{"0.0.0.0"}, Port: 8388, Password: "password", Method: "aes-256-cfb", Timeout: 60}
+		for _, step := range c.steps {
+			switch step {
+			case restart:
+				s.rollCounter()
+			case reload:
+				restored := &Server{}
+				if err := restored.restore(s.state()); err != nil {
+					t.Fatalf("%s: restore: %s", c.name, err)
+				}
+				s = restored
+			default:
+				s.updateTraffic(step)
+			}
+		}
+		if got := s.GetStat().Traffic; got != c.want {
+			t.Errorf("%s: traffic = %d, want %d", c.name, got, c.want)
+		}
+	}
+}
+
+func TestHostsHasIPv6(t *testing.T) {
+	cases := []struct {
+		hosts Hosts
+		want  bool
+	}{
+		{Hosts{"0.0.0.0"}, false},
+		{Hosts{"127.0.0.1", "10.0.0.1"}, false},
+		{Hosts{"::"}, true},
+		{Hosts{"0.0.0.0", "::"}, true},
+		{Hosts{"2001:db8::1"}, true},
+		// IPv4-mapped addresses are served through iptables
+		{Hosts{"::ffff:10.0.0.1"}, false},
+		{Hosts{}, false},
+	}
+	for _, c := range cases {
+		if got := c.hosts.hasIPv6(); got != c.want {
+			t.Errorf("%v.hasIPv6() = %t, want %t", c.hosts, got, c.want)
+		}
+	}
+}
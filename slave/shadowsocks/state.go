@@ -0,0 +1,217 @@
+package shadowsocks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// stateVersion is the version of the state file format, bump it when the format is changed
+// incompatibly.
+const stateVersion = 1
+
+const (
+	stateFileName     = "state.json"
+	quarantineDirName = "quarantine"
+)
+
+// serverState is the durable state of a managed server.
+type serverState struct {
+	Server  *Server        `json:"server"`
+	Counter trafficCounter `json:"counter"`
+	// IPv6First is kept here as options of servers are not marshaled.
+	IPv6First bool `json:"ipv6_first,omitempty"`
+	// Pid is the process of ss-server when the state is saved, 0 if it's not running.
+	Pid int `json:"pid,omitempty"`
+}
+
+// valid checks that the state describes a server on the port.
+func (st *serverState) valid(port int32) error {
+	if st.Server == nil {
+		return errors.New("server is missing")
+	}
+	if st.Server.Port != port {
+		return fmt.Errorf("port %d doesn't match the key", st.Server.Port)
+	}
+	if vs := st.Server.Validate(); len(vs) != 0 {
+		return fmt.Errorf("invalid %s, %s", vs[0].Field, vs[0].Description)
+	}
+	return nil
+}
+
+// stateFile is the format of the state file. Servers are kept as raw messages so that a broken
+// entry doesn't prevent the others from being restored.
+type stateFile struct {
+	Version int                        `json:"version"`
+	Servers map[string]json.RawMessage `json:"servers"`
+}
+
+// stateStore keeps the states of all managed servers in a single file under dir, the file is
+// replaced atomically on every save.
+type stateStore struct {
+	dir string
+}
+
+func (st *stateStore) filename() string {
+	return path.Join(st.dir, stateFileName)
+}
+
+// quarantine moves the broken data aside for inspection, instead of deleting it.
+func (st *stateStore) quarantine(name string, data []byte) {
+	dir := path.Join(st.dir, quarantineDirName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Warnf("Can not create quarantine dir, %s", err)
+		return
+	}
+	filename := path.Join(dir, fmt.Sprintf("%s.%d", name, time.Now().Unix()))
+	if err := ioutil.WriteFile(filename, data, 0600); err != nil {
+		log.Warnf("Can not quarantine %s, %s", name, err)
+		return
+	}
+	log.Warnf("Quarantined %s to %s", name, filename)
+}
+
+// quarantineDir moves a directory left by a broken server aside.
+func (st *stateStore) quarantineDir(name string) {
+	dir := path.Join(st.dir, quarantineDirName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Warnf("Can not create quarantine dir, %s", err)
+		return
+	}
+	dst := path.Join(dir, fmt.Sprintf("%s.%d", name, time.Now().Unix()))
+	if err := os.Rename(path.Join(st.dir, name), dst); err != nil {
+		log.Warnf("Can not quarantine %s, %s", name, err)
+		return
+	}
+	log.Warnf("Quarantined %s to %s", name, dst)
+}
+
+// Load reads the states of servers. Broken entries are quarantined and skipped, a file of a
+// newer version is an error, so that it's never overwritten by an older slave.
+func (st *stateStore) Load() (map[int32]*serverState, error) {
+	data, err := ioutil.ReadFile(st.filename())
+	if os.IsNotExist(err) {
+		return st.loadLegacy()
+	} else if err != nil {
+		return nil, err
+	}
+
+	var f stateFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		log.Warnf("Can not parse state file, %s", err)
+		st.quarantine(stateFileName, data)
+		return make(map[int32]*serverState), nil
+	}
+	if f.Version > stateVersion {
+		return nil, fmt.Errorf("state file version %d is newer than %d", f.Version, stateVersion)
+	}
+
+	states := make(map[int32]*serverState)
+	for key, raw := range f.Servers {
+		port, ok := getPort(key)
+		if !ok {
+			log.Warnf("Invalid port %s in state file", key)
+			st.quarantine(key, raw)
+			continue
+		}
+		s := &serverState{}
+		err := json.Unmarshal(raw, s)
+		if err == nil {
+			err = s.valid(port)
+		}
+		if err != nil {
+			log.Warnf("Broken state of server(%d), %s", port, err)
+			st.quarantine(key, raw)
+			continue
+		}
+		states[port] = s
+	}
+	return states, nil
+}
+
+// loadLegacy reads the states from the per server dirs used before the state file. The dirs
+// are left as they are, they'll be overwritten by the servers restored.
+func (st *stateStore) loadLegacy() (map[int32]*serverState, error) {
+	states := make(map[int32]*serverState)
+
+	names, err := readDirNames(st.dir)
+	if os.IsNotExist(err) {
+		return states, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		port, ok := getPort(name)
+		if !ok || !isDir(path.Join(st.dir, name)) {
+			continue
+		}
+		s, err := readLegacyState(path.Join(st.dir, name))
+		if err == nil {
+			err = s.valid(port)
+		}
+		if err != nil {
+			log.Warnf("Can not migrate server(%d), %s", port, err)
+			st.quarantineDir(name)
+			continue
+		}
+		log.Infof("Migrating server(%d) to state file", port)
+		states[port] = s
+	}
+	return states, nil
+}
+
+func readLegacyState(runPath string) (*serverState, error) {
+	s := &serverState{Server: &Server{}}
+
+	data, err := ioutil.ReadFile(path.Join(runPath, "ss_server.conf"))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, s.Server); err != nil {
+		return nil, err
+	}
+
+	data, err = ioutil.ReadFile(path.Join(runPath, "traffic.json"))
+	if err == nil {
+		err = json.Unmarshal(data, &s.Counter)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Warnf("Can not read traffic in %s, %s", runPath, err)
+	}
+
+	if pid, err := readPidFile(path.Join(runPath, "ss_server.pid")); err == nil {
+		s.Pid = pid
+	}
+	return s, nil
+}
+
+// Save writes the states of all servers, replacing the previous file atomically.
+func (st *stateStore) Save(states map[int32]*serverState) error {
+	f := stateFile{
+		Version: stateVersion,
+		Servers: make(map[string]json.RawMessage, len(states)),
+	}
+	for port, s := range states {
+		raw, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		f.Servers[strconv.Itoa(int(port))] = raw
+	}
+
+	data, err := json.MarshalIndent(&f, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(st.dir, 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(st.filename(), data, 0600)
+}
@@ -0,0 +1,169 @@
+package shadowsocks
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func testServer(port int32) *Server {
+	return &Server{
+		Hosts:    Hosts{"0.0.0.0"},
+		Port:     port,
+		Password: "password",
+		Method:   "aes-256-cfb",
+		Timeout:  60,
+	}
+}
+
+// writeFiles writes the files relative to dir, creating the dirs in between.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		filename := path.Join(dir, name)
+		if err := os.MkdirAll(path.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func quarantined(t *testing.T, dir string) int {
+	names, err := readDirNames(path.Join(dir, quarantineDirName))
+	if os.IsNotExist(err) {
+		return 0
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return len(names)
+}
+
+func TestStateStoreSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssmgr-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	st := &stateStore{dir: path.Join(dir, "run")}
+	states := map[int32]*serverState{
+		8388: {Server: testServer(8388), Counter: trafficCounter{Base: 100, Last: 20}, Pid: 42},
+		8389: {Server: testServer(8389), IPv6First: true},
+	}
+	if err := st.Save(states); err != nil {
+		t.Fatalf("Save: %s", err)
+	}
+	loaded, err := st.Load()
+	if err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	if !reflect.DeepEqual(loaded, states) {
+		t.Errorf("Load = %+v, want %+v", loaded, states)
+	}
+}
+
+func TestStateStoreLoad(t *testing.T) {
+	const server8388 = `{"server": "0.0.0.0", "server_port": 8388, "password": "password", "method": "aes-256-cfb", "timeout": 60}`
+
+	cases := []struct {
+		name        string
+		files       map[string]string
+		wantErr     bool
+		wantPorts   []int32
+		wantCounter trafficCounter
+		// wantQuarantined is the number of entries moved to the quarantine dir
+		wantQuarantined int
+	}{
+		{
+			name: "no state",
+		},
+		{
+			name: "state file",
+			files: map[string]string{
+				stateFileName: `{"version": 1, "servers": {"8388": {"server": ` + server8388 + `, "counter": {"base": 10, "last": 5}}}}`,
+			},
+			wantPorts:   []int32{8388},
+			wantCounter: trafficCounter{Base: 10, Last: 5},
+		},
+		{
+			name:            "unparsable state file",
+			files:           map[string]string{stateFileName: `{"version": 1, "servers": `},
+			wantQuarantined: 1,
+		},
+		{
+			name:    "newer state file",
+			files:   map[string]string{stateFileName: `{"version": 2, "servers": {}}`},
+			wantErr: true,
+		},
+		{
+			name: "broken entries",
+			files: map[string]string{
+				stateFileName: `{"version": 1, "servers": {
+"8388": {"server": ` + server8388 + `},
+"8389": {"server": ` + server8388 + `},
+"8390": {"counter": {}},
+"8391": [],
+"port": {"server": ` + server8388 + `}}}`,
+			},
+			wantPorts:       []int32{8388},
+			wantQuarantined: 4,
+		},
+		{
+			name: "legacy dirs",
+			files: map[string]string{
+				"8388/ss_server.conf":  server8388,
+				"8388/traffic.json":    `{"base": 30, "last": 7}`,
+				"8388/ss_server.pid":   "not a pid",
+				"8389/ss_server.conf":  `{"server": "0.0.0.0", "server_port": 8389`,
+				"8390/traffic.json":    `{"base": 1}`,
+				"other/ss_server.conf": server8388,
+			},
+			wantPorts:       []int32{8388},
+			wantCounter:     trafficCounter{Base: 30, Last: 7},
+			wantQuarantined: 2,
+		},
+		{
+			name: "state file over legacy dirs",
+			files: map[string]string{
+				stateFileName:         `{"version": 1, "servers": {}}`,
+				"8388/ss_server.conf": server8388,
+			},
+		},
+	}
+	for _, c := range cases {
+		dir, err := ioutil.TempDir("", "ssmgr-state")
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeFiles(t, dir, c.files)
+
+		states, err := (&stateStore{dir: dir}).Load()
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("%s: Load succeeded, want error", c.name)
+			}
+		} else if err != nil {
+			t.Errorf("%s: Load: %s", c.name, err)
+		} else {
+			var ports []int32
+			for port := range states {
+				ports = append(ports, port)
+			}
+			if len(ports) != len(c.wantPorts) || (len(ports) == 1 && ports[0] != c.wantPorts[0]) {
+				t.Errorf("%s: ports = %v, want %v", c.name, ports, c.wantPorts)
+			}
+			for _, s := range states {
+				if s.Counter != c.wantCounter {
+					t.Errorf("%s: counter = %+v, want %+v", c.name, s.Counter, c.wantCounter)
+				}
+			}
+		}
+		if n := quarantined(t, dir); n != c.wantQuarantined {
+			t.Errorf("%s: %d quarantined, want %d", c.name, n, c.wantQuarantined)
+		}
+		os.RemoveAll(dir)
+	}
+}
@@ -15,5 +15,13 @@ openssl req -new -key server.key -out server.csr
 echo subjectAltName = IP:127.0.0.1 > extfile.cnf
 openssl x509 -req -days 3650 -in server.csr -CA ca.pem -CAkey ca.key -CAcreateserial -out server.crt -extfile extfile.cnf
 
+# Client certificate presented by the master, slaves verify it with ca.pem
+
+openssl genrsa -out client.key 2048
+openssl req -new -key client.key -out client.csr -subj "/CN=master"
+
+echo extendedKeyUsage = clientAuth > extfile.cnf
+openssl x509 -req -days 3650 -in client.csr -CA ca.pem -CAkey ca.key -CAcreateserial -out client.crt -extfile extfile.cnf
+
 # Remove useless files
-rm server.csr extfile.cnf ca.srl
+rm server.csr client.csr extfile.cnf ca.srl
@@ -12,12 +12,13 @@ if [ \( "$(uname -s)" = "Darwin" -a "$(which getopt)" = "/usr/bin/getopt" \) ];
     exit 3
 fi
 
-SHORT_OPTS=i:,n:,d:,o:,c:,s:,v,h
-LONG_OPTS=ip:,numbits:,days:,output:,ca:,serial:,verbose,help
+SHORT_OPTS=i:,m:,n:,d:,o:,c:,s:,v,h
+LONG_OPTS=ip:,master:,numbits:,days:,output:,ca:,serial:,verbose,help
 
 usage() {
     echo """Usage: $0 [options]
     -i/--ip         <ip, default 127.0.0.1>
+    -m/--master     <name, generate a client certificate for master instead>
     -o/--output     <output dir, default .>
     -n/--numbits    <bits, default 2048>
     -d/--days       <days, default 365>
@@ -29,6 +30,7 @@ usage() {
 # params parsed from opts, initialize with their defaults values
 
 IP=127.0.0.1
+MASTER=
 OUT_DIR=.
 NUMBITS=2048
 DAYS=365
@@ -72,6 +74,10 @@ parse_params() {
                 IP=$2
                 shift 2
                 ;;
+            -m|--master)
+                MASTER=$2
+                shift 2
+                ;;
             -o|--output)
                 OUT_DIR=$2
                 shift 2
@@ -133,14 +139,23 @@ sign_key() {
     ca_key=$5
     outfile=$6
     ca_serial_opt=$7
-
-    echo "Generating server cert ($days days, $ip), saving to $outfile"
-    echo
+    master=$8
 
     tmpdir=/tmp/ssl_gen_$(head -c 40 /dev/urandom | base64 -i - | sed "s/\\//_/g")
     mkdir -p $tmpdir
-    echo subjectAltName = IP:$ip > $tmpdir/extfile.cnf
-    openssl req -new -key $key_file -out $tmpdir/server.csr
+    if [ -z "$master" ]; then
+        echo "Generating server cert ($days days, $ip), saving to $outfile"
+        echo
+
+        echo subjectAltName = IP:$ip > $tmpdir/extfile.cnf
+        openssl req -new -key $key_file -out $tmpdir/server.csr
+    else
+        echo "Generating master client cert ($days days, $master), saving to $outfile"
+        echo
+
+        echo extendedKeyUsage = clientAuth > $tmpdir/extfile.cnf
+        openssl req -new -key $key_file -out $tmpdir/server.csr -subj "/CN=$master"
+    fi
     # openssl x509 -req -days $days -in $tmpdir/server.csr -CA $ca_cert -CAkey $ca_key <-CAserial srlfile> -out $outfile -extfile $tmpdir/extfile.cnf
     openssl x509 -req -days $days -in $tmpdir/server.csr -CA $ca_cert -CAkey $ca_key $ca_serial_opt -out $outfile -extfile $tmpdir/extfile.cnf
     rm -r $tmpdir
@@ -159,10 +174,15 @@ if [ 1 -eq $VERBOSE ]; then
     set -vx
 fi
 
-# generate server key
-IP_U=$(echo $IP | sed 's/\./_/g')
-SERVER_KEY=$OUT_DIR/server_$IP_U.key
-SERVER_CERT=$OUT_DIR/server_$IP_U.crt
+# generate server key, or client key of master
+if [ -z "$MASTER" ]; then
+    IP_U=$(echo $IP | sed 's/\./_/g')
+    SERVER_KEY=$OUT_DIR/server_$IP_U.key
+    SERVER_CERT=$OUT_DIR/server_$IP_U.crt
+else
+    SERVER_KEY=$OUT_DIR/client_$MASTER.key
+    SERVER_CERT=$OUT_DIR/client_$MASTER.crt
+fi
 
 generate_key $NUMBITS $SERVER_KEY
 if [ $? -ne 0 ]; then
@@ -197,7 +217,7 @@ fi
 # sign server key
 
 echo
-sign_key $IP $DAYS $SERVER_KEY $CA_DIR/ca.pem $CA_DIR/ca.key $SERVER_CERT "$CA_SERIAL_OPT"
+sign_key $IP $DAYS $SERVER_KEY $CA_DIR/ca.pem $CA_DIR/ca.key $SERVER_CERT "$CA_SERIAL_OPT" "$MASTER"
 if [ $? -ne 0 ]; then
     echo "Failed"
     exit 1